@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	gapModeSplit    = "split"
+	gapModeChapters = "chapters"
+
+	chaptersHour    = "hour"
+	chaptersSegment = "segment"
+)
+
+type chapter struct {
+	Start time.Duration
+	End   time.Duration
+	Title string
+}
+
+// splitAtGaps cuts time-ordered segments into continuous recording blocks,
+// starting a new block whenever the pause before a segment exceeds threshold.
+func splitAtGaps(segs []Segment, threshold time.Duration) [][]Segment {
+	if len(segs) == 0 {
+		return nil
+	}
+	blocks := [][]Segment{{segs[0]}}
+	for i := 1; i < len(segs); i++ {
+		if segs[i].StartTime.Sub(segs[i-1].EndTime) > threshold {
+			blocks = append(blocks, nil)
+		}
+		blocks[len(blocks)-1] = append(blocks[len(blocks)-1], segs[i])
+	}
+	return blocks
+}
+
+// blockChapters returns one chapter per recording block, placed on the
+// playback timeline of the concatenated blocks.
+func blockChapters(blocks [][]Segment) []chapter {
+	chapters := make([]chapter, 0, len(blocks))
+	var pos time.Duration
+	for _, block := range blocks {
+		d := segmentsDuration(block)
+		first := block[0].StartTime
+		last := block[len(block)-1].EndTime
+		chapters = append(chapters, chapter{
+			Start: pos,
+			End:   pos + d,
+			Title: fmt.Sprintf("%s - %s", first.Format("15:04:05"), last.Format("15:04:05")),
+		})
+		pos += d
+	}
+	return chapters
+}
+
+// segmentOffsets returns each segment's start on the playback timeline of the
+// concatenated output, using the durations encoded in the segment names.
+func segmentOffsets(segs []Segment) []time.Duration {
+	offsets := make([]time.Duration, len(segs))
+	var pos time.Duration
+	for i, s := range segs {
+		offsets[i] = pos
+		if d := s.EndTime.Sub(s.StartTime); d > 0 {
+			pos += d
+		}
+	}
+	return offsets
+}
+
+// hourChapters adds a chapter at the first footage of every wall-clock hour.
+func hourChapters(segs []Segment) []chapter {
+	offsets := segmentOffsets(segs)
+	var chapters []chapter
+	var lastHour time.Time
+	for i, s := range segs {
+		st := s.StartTime
+		hour := time.Date(st.Year(), st.Month(), st.Day(), st.Hour(), 0, 0, 0, st.Location())
+		for ; hour.Before(s.EndTime); hour = hour.Add(time.Hour) {
+			if !lastHour.IsZero() && !hour.After(lastHour) {
+				continue
+			}
+			pos := offsets[i]
+			if hour.After(st) {
+				pos += hour.Sub(st)
+			}
+			chapters = append(chapters, chapter{Start: pos, Title: hour.Format("15:04")})
+			lastHour = hour
+		}
+	}
+	return chapters
+}
+
+// segmentChapters adds a chapter at the start of every original segment.
+func segmentChapters(segs []Segment) []chapter {
+	offsets := segmentOffsets(segs)
+	chapters := make([]chapter, 0, len(segs))
+	for i, s := range segs {
+		chapters = append(chapters, chapter{Start: offsets[i], Title: s.StartTime.Format("15:04:05")})
+	}
+	return chapters
+}
+
+// normalizeChapters orders chapters, drops duplicates starting at the same
+// position and makes each chapter end where the next one begins.
+func normalizeChapters(chapters []chapter, total time.Duration) []chapter {
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	out := make([]chapter, 0, len(chapters))
+	for _, c := range chapters {
+		if len(out) > 0 && out[len(out)-1].Start == c.Start {
+			continue
+		}
+		out = append(out, c)
+	}
+	for i := range out {
+		if i+1 < len(out) {
+			out[i].End = out[i+1].Start
+		} else {
+			out[i].End = total
+		}
+	}
+	return out
+}
+
+// outputChapters combines the configured chapter kinds for one output.
+func outputChapters(cfg Config, segs []Segment, extra []chapter) []chapter {
+	chapters := append([]chapter(nil), extra...)
+	if cfg.ChapterHours {
+		chapters = append(chapters, hourChapters(segs)...)
+	}
+	if cfg.ChapterSegments {
+		chapters = append(chapters, segmentChapters(segs)...)
+	}
+	if len(chapters) == 0 {
+		return nil
+	}
+	return normalizeChapters(chapters, segmentsDuration(segs))
+}
+
+// parseChapterKinds parses a comma-separated list of hour/segment.
+func parseChapterKinds(v string) (hours, segments bool, err error) {
+	for _, k := range strings.Split(v, ",") {
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "", "none":
+		case chaptersHour:
+			hours = true
+		case chaptersSegment:
+			segments = true
+		default:
+			return false, false, fmt.Errorf("unknown chapter kind '%s' (want %s or %s)", k, chaptersHour, chaptersSegment)
+		}
+	}
+	return hours, segments, nil
+}
+
+func escapeFFMetadata(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", `\`+"\n")
+	return r.Replace(s)
+}
+
+// writeChapterMetadata writes chapters in FFMETADATA1 format to a temp file.
+func writeChapterMetadata(chapters []chapter) (string, func(), error) {
+	f, err := os.CreateTemp("", "chapters_*.txt")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() {
+		_ = os.Remove(f.Name())
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, ";FFMETADATA1")
+	for _, c := range chapters {
+		fmt.Fprintln(w, "[CHAPTER]")
+		fmt.Fprintln(w, "TIMEBASE=1/1000")
+		fmt.Fprintf(w, "START=%d\n", c.Start.Milliseconds())
+		fmt.Fprintf(w, "END=%d\n", c.End.Milliseconds())
+		fmt.Fprintf(w, "title=%s\n", escapeFFMetadata(c.Title))
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		cleanup()
+		return "", func() {}, err
+	}
+	if err := f.Close(); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return f.Name(), cleanup, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// Clock tells the time and waits. Merge scope, retention cutoffs and the
+// daemon schedule all read it, so a fixed clock pins their behaviour.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the wall clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// clock returns the configured Clock, defaulting to the wall clock.
+func (cfg Config) clock() Clock {
+	if cfg.Clock != nil {
+		return cfg.Clock
+	}
+	return systemClock{}
+}
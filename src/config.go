@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,6 +17,34 @@ const (
 	envDays       = "XIAOMI_VIDEO_DAYS"
 	envMergedDays = "XIAOMI_VIDEO_MERGED_DAYS"
 	envCron       = "XIAOMI_VIDEO_CRON"
+	envSchemes    = "XIAOMI_VIDEO_SCHEMES"
+	envPattern    = "XIAOMI_VIDEO_PATTERN"
+	envLayout     = "XIAOMI_VIDEO_PATTERN_LAYOUT"
+	envGap        = "XIAOMI_VIDEO_GAP"
+	envGapMode    = "XIAOMI_VIDEO_GAP_MODE"
+	envChapters   = "XIAOMI_VIDEO_CHAPTERS"
+	envTimestamps = "XIAOMI_VIDEO_TIMESTAMPS"
+	envWorkers    = "XIAOMI_VIDEO_WORKERS"
+	envMidnight   = "XIAOMI_VIDEO_SPLIT_MIDNIGHT"
+	envCameraTZ   = "XIAOMI_VIDEO_CAMERA_TZ"
+	envSourceTZ   = "XIAOMI_VIDEO_SOURCE_TZ"
+	envOffsets    = "XIAOMI_VIDEO_SOURCE_OFFSET"
+	envOverlap    = "XIAOMI_VIDEO_OVERLAP"
+	envQuarantine = "XIAOMI_VIDEO_QUARANTINE_DIR"
+	envMismatch   = "XIAOMI_VIDEO_MISMATCH"
+	envTranscode  = "XIAOMI_VIDEO_TRANSCODE"
+	envSourceTC   = "XIAOMI_VIDEO_SOURCE_TRANSCODE"
+	envTimelapse  = "XIAOMI_VIDEO_TIMELAPSE"
+	envTLDays     = "XIAOMI_VIDEO_TIMELAPSE_DAYS"
+	envScene      = "XIAOMI_VIDEO_SCENE"
+	envPadding    = "XIAOMI_VIDEO_EVENT_PADDING"
+	envHighlights = "XIAOMI_VIDEO_HIGHLIGHTS"
+	envThumbnails = "XIAOMI_VIDEO_THUMBNAILS"
+	envBackend    = "XIAOMI_VIDEO_MERGE_BACKEND"
+	envDryRun     = "XIAOMI_VIDEO_DRY_RUN"
+	envMaxRaw     = "XIAOMI_VIDEO_MAX_RAW_BYTES"
+	envMaxMerged  = "XIAOMI_VIDEO_MAX_MERGED_BYTES"
+	envMinFree    = "XIAOMI_VIDEO_MIN_FREE_PERCENT"
 )
 
 func envString(key, def string) string {
@@ -52,6 +81,35 @@ func envOptionalInt(key string) (*int, error) {
 	return nil, nil
 }
 
+func envBool(key string) (bool, error) {
+	if v, ok := os.LookupEnv(key); ok && strings.TrimSpace(v) != "" {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("%s must be true or false: %w", key, err)
+		}
+		return b, nil
+	}
+	return false, nil
+}
+
+func envDuration(key string) (time.Duration, error) {
+	if v, ok := os.LookupEnv(key); ok && strings.TrimSpace(v) != "" {
+		return parseNonNegativeDuration(key, v)
+	}
+	return 0, nil
+}
+
+func parseNonNegativeDuration(name, v string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration (e.g. 10m): %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must be >= 0", name)
+	}
+	return d, nil
+}
+
 func optionalDaysText(v *int) string {
 	if v == nil {
 		return "forever"
@@ -65,6 +123,9 @@ func parseFlags() Config {
 	cfg.Dir = envString(envDir, ".")
 	cfg.OutDir = envString(envOutDir, "")
 	cfg.Cron = trimMatchingQuotes(envString(envCron, ""))
+	schemes := envString(envSchemes, defaultSchemes)
+	pattern := envString(envPattern, "")
+	layout := envString(envLayout, "")
 
 	days, err := envOptionalInt(envDays)
 	if err != nil {
@@ -80,12 +141,77 @@ func parseFlags() Config {
 	}
 	cfg.MergedDays = mergedDays
 
+	timelapseDays, err := envOptionalInt(envTLDays)
+	if err != nil {
+		logFatal("Invalid %s: %v", envTLDays, err)
+		os.Exit(2)
+	}
+	cfg.TimelapseDays = timelapseDays
+
+	cfg.GapThreshold, err = envDuration(envGap)
+	if err != nil {
+		logFatal("Invalid %s: %v", envGap, err)
+		os.Exit(2)
+	}
+	cfg.GapMode = strings.ToLower(envString(envGapMode, gapModeSplit))
+	chapters := envString(envChapters, "")
+
+	workers, err := envOptionalInt(envWorkers)
+	if err != nil {
+		logFatal("Invalid %s: %v", envWorkers, err)
+		os.Exit(2)
+	}
+	if workers != nil {
+		cfg.Workers = *workers
+	}
+
+	cfg.ThumbnailInterval, err = envDuration(envThumbnails)
+	if err != nil {
+		logFatal("Invalid %s: %v", envThumbnails, err)
+		os.Exit(2)
+	}
+
+	cfg.SplitMidnight, err = envBool(envMidnight)
+	if err != nil {
+		logFatal("Invalid %s: %v", envMidnight, err)
+		os.Exit(2)
+	}
+	cfg.Highlights, err = envBool(envHighlights)
+	if err != nil {
+		logFatal("Invalid %s: %v", envHighlights, err)
+		os.Exit(2)
+	}
+	cfg.DryRun, err = envBool(envDryRun)
+	if err != nil {
+		logFatal("Invalid %s: %v", envDryRun, err)
+		os.Exit(2)
+	}
+	cameraTZ := envString(envCameraTZ, "")
+	sourceTZ := envString(envSourceTZ, "")
+	offsets := envString(envOffsets, "")
+	cfg.Timestamps = envString(envTimestamps, "")
+	cfg.Overlap = envString(envOverlap, overlapKeep)
+	cfg.QuarantineDir = envString(envQuarantine, "")
+	cfg.Mismatch = envString(envMismatch, mismatchSplit)
+	cfg.MergeBackend = envString(envBackend, mergeBackendFFmpeg)
+	transcode := envString(envTranscode, "")
+	sourceTranscode := envString(envSourceTC, "")
+	timelapse := envString(envTimelapse, "")
+	maxRaw := envString(envMaxRaw, "")
+	maxMerged := envString(envMaxMerged, "")
+	minFree := envString(envMinFree, "")
+	scene := envString(envScene, "")
+	padding := envString(envPadding, "5s")
+
 	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
 
 	fs.StringVar(&cfg.Dir, "dir", cfg.Dir, "Input directory to scan")
 	fs.StringVar(&cfg.OutDir, "out-dir", cfg.OutDir, "Output directory for merged files (default: dir/daily)")
 	fs.StringVar(&cfg.Cron, "cron", cfg.Cron, "Cron schedule (5 fields: M H DOM MON DOW). If set, daemon mode is enabled")
+	fs.StringVar(&schemes, "schemes", schemes, "Comma-separated segment naming schemes (xiaomi, xiaomi-legacy, reolink, tapo, hikvision)")
+	fs.StringVar(&pattern, "pattern", pattern, "Custom segment name regexp with named captures start, end, date, camera, ext")
+	fs.StringVar(&layout, "pattern-layout", layout, "Go time layout for --pattern start/end captures (default: 20060102150405)")
 	fs.Func("days", "Raw segment retention days (unset=keep forever, 0=delete merged-day segments immediately)", func(v string) error {
 		i, err := strconv.Atoi(strings.TrimSpace(v))
 		if err != nil || i < 0 {
@@ -102,6 +228,60 @@ func parseFlags() Config {
 		cfg.MergedDays = &i
 		return nil
 	})
+	fs.Func("gap", "Split or mark recording gaps longer than this duration (e.g. 10m; unset=disabled)", func(v string) error {
+		d, err := parseNonNegativeDuration("--gap", v)
+		if err != nil {
+			return err
+		}
+		cfg.GapThreshold = d
+		return nil
+	})
+	fs.StringVar(&cfg.GapMode, "gap-mode", cfg.GapMode, "How to handle gaps: split (one file per block) or chapters (one file with chapter markers)")
+	fs.StringVar(&chapters, "chapters", chapters, "Comma-separated chapter markers for merged outputs: hour, segment")
+	fs.StringVar(&cfg.Timestamps, "timestamps", cfg.Timestamps, "Wall-clock timestamps for merged outputs: srt, vtt, mov_text or burn (re-encode)")
+	fs.Func("workers", "Concurrent source/day merges (0=auto)", func(v string) error {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || i < 0 {
+			return fmt.Errorf("--workers must be >= 0")
+		}
+		cfg.Workers = i
+		return nil
+	})
+	fs.BoolVar(&cfg.SplitMidnight, "split-midnight", cfg.SplitMidnight, "Cut segments crossing midnight at the first keyframe after 00:00 so each day holds only its own footage")
+	fs.StringVar(&cameraTZ, "camera-tz", cameraTZ, "IANA timezone of camera file names (default: process TZ)")
+	fs.StringVar(&sourceTZ, "source-tz", sourceTZ, "Per-source timezones, e.g. cam1=Asia/Shanghai,cam2=UTC")
+	fs.StringVar(&offsets, "source-offset", offsets, "Per-source clock offsets added to name timestamps, e.g. cam1=-90s,cam2=auto (*=all sources)")
+	fs.StringVar(&cfg.QuarantineDir, "quarantine-dir", cfg.QuarantineDir, "Directory for unreadable segments (default: out-dir/quarantine)")
+	fs.StringVar(&transcode, "transcode", transcode, "Encoding profile for merged outputs, e.g. h265:crf=28:max-height=720:fps=15:preset=medium:audio=mono (default: copy)")
+	fs.StringVar(&sourceTranscode, "source-transcode", sourceTranscode, "Per-source encoding profiles, e.g. cam1=h265:crf=30,cam2=copy")
+	fs.StringVar(&timelapse, "timelapse", timelapse, "Write a timelapse per day: speed-up (e.g. 60x) or target length (e.g. 2m)")
+	fs.Func("timelapse-days", "Timelapse retention days (unset=keep forever)", func(v string) error {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || i < 0 {
+			return fmt.Errorf("--timelapse-days must be >= 0")
+		}
+		cfg.TimelapseDays = &i
+		return nil
+	})
+	fs.StringVar(&scene, "scene", scene, "Scene-change score (0-1) above which an event is recorded, e.g. 0.3 (unset=disabled)")
+	fs.StringVar(&padding, "event-padding", padding, "Footage kept before and after each event clip")
+	fs.BoolVar(&cfg.Highlights, "highlights", cfg.Highlights, "Concatenate each day's event clips into a highlights reel")
+	fs.Func("thumbnails", "Write a poster and a contact sheet with one frame per this interval for each merged output (e.g. 15m; unset=disabled)", func(v string) error {
+		d, err := parseNonNegativeDuration("--thumbnails", v)
+		if err != nil {
+			return err
+		}
+		cfg.ThumbnailInterval = d
+		return nil
+	})
+	fs.StringVar(&cfg.MergeBackend, "merge-backend", cfg.MergeBackend, "Concatenation backend: ffmpeg or native (pure Go MP4 stream copy, ffmpeg as fallback)")
+	fs.StringVar(&cfg.Mismatch, "mismatch", cfg.Mismatch, "Segments with differing codec/resolution/frame rate/audio: split (one output per run) or reencode (normalise to one H.264 output)")
+	fs.StringVar(&cfg.Overlap, "overlap", cfg.Overlap, "Duplicate/overlapping segments: keep (report only, default), drop (remove duplicates and covered segments) or trim (also trim partial overlaps; the cut lands on a keyframe)")
+	fs.BoolVar(&cfg.SkewReport, "skew-report", false, "Print estimated camera clock skew per source and exit")
+	fs.StringVar(&maxRaw, "max-raw-bytes", maxRaw, "Delete the oldest merged raw segments while they use more than this, e.g. 2T (unset=no limit)")
+	fs.StringVar(&maxMerged, "max-merged-bytes", maxMerged, "Delete the oldest merged outputs while the output folder uses more than this, e.g. 1.5T (unset=no limit)")
+	fs.StringVar(&minFree, "min-free-percent", minFree, "Delete the oldest footage while the output volume has less free space than this percentage (unset=disabled)")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "Print the merges and deletions one run would make, with total bytes, without touching any file")
 	if err := fs.Parse(os.Args[1:]); err != nil {
 		logFatal("Invalid flags: %v", err)
 		os.Exit(2)
@@ -110,7 +290,124 @@ func parseFlags() Config {
 	if cfg.OutDir == "" {
 		cfg.OutDir = filepath.Join(cfg.Dir, "daily")
 	}
+	if cfg.QuarantineDir == "" {
+		cfg.QuarantineDir = filepath.Join(cfg.OutDir, "quarantine")
+	}
 	cfg.Cron = trimMatchingQuotes(cfg.Cron)
 
+	cfg.GapMode = strings.ToLower(strings.TrimSpace(cfg.GapMode))
+	if cfg.GapMode != gapModeSplit && cfg.GapMode != gapModeChapters {
+		logFatal("Invalid gap mode '%s': must be %s or %s", cfg.GapMode, gapModeSplit, gapModeChapters)
+		os.Exit(2)
+	}
+
+	cfg.ChapterHours, cfg.ChapterSegments, err = parseChapterKinds(chapters)
+	if err != nil {
+		logFatal("Invalid chapters: %v", err)
+		os.Exit(2)
+	}
+
+	cfg.Timestamps = strings.ToLower(strings.TrimSpace(cfg.Timestamps))
+	if cfg.Timestamps == "none" {
+		cfg.Timestamps = ""
+	}
+	if !validTimestampMode(cfg.Timestamps) {
+		logFatal("Invalid timestamps mode '%s': must be srt, vtt, mov_text or burn", cfg.Timestamps)
+		os.Exit(2)
+	}
+
+	cfg.Overlap = strings.ToLower(strings.TrimSpace(cfg.Overlap))
+	if !validOverlapPolicy(cfg.Overlap) {
+		logFatal("Invalid overlap policy '%s': must be %s, %s or %s", cfg.Overlap, overlapKeep, overlapDrop, overlapTrim)
+		os.Exit(2)
+	}
+
+	cfg.MergeBackend = strings.ToLower(strings.TrimSpace(cfg.MergeBackend))
+	if cfg.MergeBackend != mergeBackendFFmpeg && cfg.MergeBackend != mergeBackendNative {
+		logFatal("Invalid merge backend '%s': must be %s or %s", cfg.MergeBackend, mergeBackendFFmpeg, mergeBackendNative)
+		os.Exit(2)
+	}
+
+	cfg.Mismatch = strings.ToLower(strings.TrimSpace(cfg.Mismatch))
+	if cfg.Mismatch != mismatchSplit && cfg.Mismatch != mismatchReencode {
+		logFatal("Invalid mismatch mode '%s': must be %s or %s", cfg.Mismatch, mismatchSplit, mismatchReencode)
+		os.Exit(2)
+	}
+
+	cfg.Transcode, err = parseTranscodeProfile(trimMatchingQuotes(transcode))
+	if err != nil {
+		logFatal("Invalid transcode profile: %v", err)
+		os.Exit(2)
+	}
+	cfg.SourceTranscode, err = parseTranscodeProfiles(trimMatchingQuotes(sourceTranscode))
+	if err != nil {
+		logFatal("Invalid source transcode profile: %v", err)
+		os.Exit(2)
+	}
+
+	cfg.TimelapseSpeed, cfg.TimelapseLength, err = parseTimelapse(trimMatchingQuotes(timelapse))
+	if err != nil {
+		logFatal("Invalid timelapse: %v", err)
+		os.Exit(2)
+	}
+
+	if maxRaw = trimMatchingQuotes(maxRaw); maxRaw != "" {
+		cfg.MaxRawBytes, err = parseByteSize(maxRaw)
+		if err != nil {
+			logFatal("Invalid raw quota: %v", err)
+			os.Exit(2)
+		}
+	}
+	if maxMerged = trimMatchingQuotes(maxMerged); maxMerged != "" {
+		cfg.MaxMergedBytes, err = parseByteSize(maxMerged)
+		if err != nil {
+			logFatal("Invalid merged quota: %v", err)
+			os.Exit(2)
+		}
+	}
+	if minFree = strings.TrimSuffix(trimMatchingQuotes(minFree), "%"); minFree != "" {
+		cfg.MinFreePercent, err = strconv.ParseFloat(minFree, 64)
+		if err != nil || cfg.MinFreePercent < 0 || cfg.MinFreePercent >= 100 {
+			logFatal("Invalid min free percent '%s': must be >= 0 and < 100", minFree)
+			os.Exit(2)
+		}
+	}
+
+	if scene = strings.TrimSpace(scene); scene != "" {
+		cfg.SceneThreshold, err = strconv.ParseFloat(scene, 64)
+		if err != nil || cfg.SceneThreshold <= 0 || cfg.SceneThreshold > 1 {
+			logFatal("Invalid scene threshold '%s': must be > 0 and <= 1", scene)
+			os.Exit(2)
+		}
+	}
+	cfg.EventPadding, err = parseNonNegativeDuration("--event-padding", padding)
+	if err != nil {
+		logFatal("Invalid event padding: %v", err)
+		os.Exit(2)
+	}
+
+	if cfg.ThumbnailInterval > 0 && cfg.ThumbnailInterval < time.Minute {
+		logFatal("Invalid thumbnail interval %s: must be at least 1m", cfg.ThumbnailInterval)
+		os.Exit(2)
+	}
+
+	cfg.Location, cfg.SourceLocations, err = parseLocations(trimMatchingQuotes(cameraTZ), trimMatchingQuotes(sourceTZ))
+	if err != nil {
+		logFatal("Invalid timezone: %v", err)
+		os.Exit(2)
+	}
+
+	cfg.SourceOffsets, err = parseClockOffsets(trimMatchingQuotes(offsets))
+	if err != nil {
+		logFatal("Invalid source offset: %v", err)
+		os.Exit(2)
+	}
+
+	cfg.Schemes, err = buildSchemes(schemes, trimMatchingQuotes(pattern), layout)
+	if err != nil {
+		logFatal("Invalid naming scheme: %v", err)
+		os.Exit(2)
+	}
+
 	return cfg
 }
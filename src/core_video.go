@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,88 +22,32 @@ type Segment struct {
 	StartTime time.Time
 	EndTime   time.Time
 	Ext       string
+	Scheme    string
+	DirDepth  int
+	Size      int64
+	ModTime   time.Time
+	// InPoint/OutPoint are file timestamps limiting the part of the file
+	// used (zero = from the start / to the end), e.g. after a midnight split.
+	InPoint  time.Duration
+	OutPoint time.Duration
+	// Format is filled by the pre-merge probe.
+	Format streamFormat
+	// DurationUnknown marks a segment whose end could be neither read from
+	// its name nor probed (unreadable, or still being written). EndTime then
+	// equals StartTime so merging still works, but retention never deletes
+	// the file.
+	DurationUnknown bool
 }
 
 const tsLayout = "20060102150405"
 
-func isDigits14(s string) bool {
-	if len(s) != 14 {
-		return false
-	}
-	for i := 0; i < 14; i++ {
-		if s[i] < '0' || s[i] > '9' {
-			return false
-		}
-	}
-	return true
-}
-
-func parseRawSegment(name string) (start, end time.Time, ext string, ok bool) {
-	if !strings.HasPrefix(name, "00_") {
-		return time.Time{}, time.Time{}, "", false
-	}
-	rest := name[3:]
-	if len(rest) < 29 {
-		return time.Time{}, time.Time{}, "", false
-	}
-	startStr := rest[:14]
-	if rest[14] != '_' {
-		return time.Time{}, time.Time{}, "", false
-	}
-	tail := rest[15:]
-	if len(tail) < 14 {
-		return time.Time{}, time.Time{}, "", false
-	}
-	endStr := tail[:14]
-	ext = tail[14:]
-	if ext != "" && ext[0] != '.' {
-		return time.Time{}, time.Time{}, "", false
-	}
-	if !isDigits14(startStr) || !isDigits14(endStr) {
-		return time.Time{}, time.Time{}, "", false
-	}
-	st, err1 := time.ParseInLocation(tsLayout, startStr, time.Local)
-	et, err2 := time.ParseInLocation(tsLayout, endStr, time.Local)
-	if err1 != nil || err2 != nil {
-		return time.Time{}, time.Time{}, "", false
-	}
-	return st, et, ext, true
-}
-
-// Expected merged output name format:
-// YYYYMMDDHHMMSS_YYYYMMDDHHMMSS[.ext]
-func parseMergedSegment(name string) (start, end time.Time, ext string, ok bool) {
-	if len(name) < 29 {
-		return time.Time{}, time.Time{}, "", false
-	}
-	startStr := name[:14]
-	if name[14] != '_' {
-		return time.Time{}, time.Time{}, "", false
-	}
-	tail := name[15:]
-	if len(tail) < 14 {
-		return time.Time{}, time.Time{}, "", false
-	}
-	endStr := tail[:14]
-	ext = tail[14:]
-	if ext != "" && ext[0] != '.' {
-		return time.Time{}, time.Time{}, "", false
-	}
-	if !isDigits14(startStr) || !isDigits14(endStr) {
-		return time.Time{}, time.Time{}, "", false
-	}
-	st, err1 := time.ParseInLocation(tsLayout, startStr, time.Local)
-	et, err2 := time.ParseInLocation(tsLayout, endStr, time.Local)
-	if err1 != nil || err2 != nil {
-		return time.Time{}, time.Time{}, "", false
-	}
-	return st, et, ext, true
-}
-
 type DayGroup struct {
 	Day       string
 	SourceKey string
 	Segments  []Segment
+	// Rebuilt is set by mergeGroup when it wrote (or, in a dry run, planned)
+	// new outputs rather than finding them up to date.
+	Rebuilt bool
 }
 
 type Config struct {
@@ -111,18 +56,92 @@ type Config struct {
 	Days       *int
 	MergedDays *int
 	Cron       string
+	Schemes    []SegmentScheme
+	// GapThreshold > 0 enables gap detection between consecutive segments.
+	GapThreshold time.Duration
+	GapMode      string
+	// Chapter markers added to each merged output.
+	ChapterHours    bool
+	ChapterSegments bool
+	// Timestamps selects how wall-clock time is attached to merged outputs.
+	Timestamps string
+	// Workers is the number of concurrent merges (0 = automatic).
+	Workers int
+	// SplitMidnight cuts segments crossing midnight between both days.
+	SplitMidnight bool
+	// Location is the default camera timezone; SourceLocations overrides it
+	// per source folder.
+	Location        *time.Location
+	SourceLocations map[string]*time.Location
+	// SourceOffsets corrects camera clock skew per source folder.
+	SourceOffsets map[string]clockOffset
+	// Transcode is the global encoding profile for merged outputs;
+	// SourceTranscode overrides it per source folder.
+	Transcode       transcodeProfile
+	SourceTranscode map[string]transcodeProfile
+	// TimelapseSpeed or TimelapseLength enables a timelapse per day;
+	// TimelapseDays is its retention (nil = keep forever).
+	TimelapseSpeed  float64
+	TimelapseLength time.Duration
+	TimelapseDays   *int
+	// SceneThreshold enables scene-change events (0 = disabled); each event
+	// is exported as a clip padded by EventPadding on both sides, and
+	// Highlights concatenates the clips into a daily reel.
+	SceneThreshold float64
+	EventPadding   time.Duration
+	Highlights     bool
+	// ThumbnailInterval enables a poster and a contact sheet with one frame
+	// per interval for every merged output (0 = disabled).
+	ThumbnailInterval time.Duration
+	// MergeBackend is ffmpeg or native (pure-Go MP4, ffmpeg as fallback).
+	MergeBackend string
+	// Merger runs probes, concats and re-encodes; nil means ffmpeg with
+	// MergeBackend.
+	Merger Merger
+	// Durations keeps the probed durations of open-ended segments for a
+	// run, which lists the segments more than once; nil probes every time.
+	Durations *durationCache
+	// Clock and FS default to the wall clock and the host filesystem.
+	Clock Clock
+	FS    FileSystem
+	// Mismatch selects split or reencode when segment formats differ.
+	Mismatch string
+	// QuarantineDir receives segments ffprobe cannot read.
+	QuarantineDir string
+	// Overlap is the policy for duplicate and overlapping segments.
+	Overlap string
+	// SkewReport prints estimated clock skew per source and exits.
+	SkewReport bool
+	// MaxRawBytes and MaxMergedBytes cap raw segments and the output folder
+	// (0 = no limit); MinFreePercent keeps that much of the output volume
+	// free. The oldest footage is deleted first, after each merge.
+	MaxRawBytes    int64
+	MaxMergedBytes int64
+	MinFreePercent float64
+	// DryRun runs one pass against Plan instead of the filesystem and
+	// prints what it would merge and delete.
+	DryRun bool
+	Plan   *dryRunPlan
 }
 
 const (
 	mergedOutExt          = ".mp4"
 	mp4VideoTrackTimebase = 90000
 	logTimeLayout         = time.RFC3339
+	// Segments without an encoded end (e.g. legacy Xiaomi) are about one
+	// minute long; when one cannot be probed, a successor starting within
+	// this is taken as its end and a later one as a recording gap.
+	inferSegmentMaxLen = 5 * time.Minute
 )
 
 func logLine(level, format string, args ...any) {
+	logLineAt(time.Now(), level, format, args...)
+}
+
+func logLineAt(t time.Time, level, format string, args ...any) {
 	msg := strings.TrimSpace(fmt.Sprintf(format, args...))
 	msg = strings.ReplaceAll(msg, "\n", "\\n")
-	log.Printf("%s [%s] %s", time.Now().Format(logTimeLayout), level, msg)
+	log.Printf("%s [%s] %s", t.Format(logTimeLayout), level, msg)
 }
 
 func logInfo(format string, args ...any)  { logLine("INFO", format, args...) }
@@ -147,7 +166,7 @@ func ensureFFmpeg() error {
 	return err
 }
 
-func runFFmpeg(args []string) error {
+func runFFmpeg(args []string, lg *logBuffer) error {
 	ffmpegArgs := make([]string, 0, len(args)+4)
 	ffmpegArgs = append(ffmpegArgs, "-hide_banner", "-nostats", "-loglevel", "error")
 	ffmpegArgs = append(ffmpegArgs, args...)
@@ -166,15 +185,15 @@ func runFFmpeg(args []string) error {
 
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go streamProcessOutput("stdout", stdout, &wg)
-	go streamProcessOutput("stderr", stderr, &wg)
+	go streamProcessOutput("stdout", stdout, &wg, lg)
+	go streamProcessOutput("stderr", stderr, &wg, lg)
 
 	waitErr := cmd.Wait()
 	wg.Wait()
 	return waitErr
 }
 
-func streamProcessOutput(stream string, r io.Reader, wg *sync.WaitGroup) {
+func streamProcessOutput(stream string, r io.Reader, wg *sync.WaitGroup, lg *logBuffer) {
 	defer wg.Done()
 	scanner := bufio.NewScanner(r)
 	buf := make([]byte, 0, 64*1024)
@@ -185,13 +204,13 @@ func streamProcessOutput(stream string, r io.Reader, wg *sync.WaitGroup) {
 			continue
 		}
 		if stream == "stderr" {
-			logError("FFmpeg: %s", line)
+			lg.Error("FFmpeg: %s", line)
 		} else {
-			logInfo("FFmpeg: %s", line)
+			lg.Info("FFmpeg: %s", line)
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		logWarn("FFmpeg %s stream read error: %v", stream, err)
+		lg.Warn("FFmpeg %s stream read error: %v", stream, err)
 	}
 }
 
@@ -217,6 +236,12 @@ func writeConcatList(segs []Segment) (string, func(), error) {
 			cleanup()
 			return "", func() {}, err
 		}
+		if s.InPoint > 0 {
+			fmt.Fprintf(w, "inpoint %.6f\n", s.InPoint.Seconds())
+		}
+		if s.OutPoint > 0 {
+			fmt.Fprintf(w, "outpoint %.6f\n", s.OutPoint.Seconds())
+		}
 	}
 	if err := w.Flush(); err != nil {
 		_ = f.Close()
@@ -230,62 +255,237 @@ func writeConcatList(segs []Segment) (string, func(), error) {
 	return f.Name(), cleanup, nil
 }
 
-func runFFmpegConcat(listFile, outPath string) error {
-	args := []string{"-y", "-f", "concat", "-safe", "0", "-i", listFile}
+type concatJob struct {
+	ListFile string
+	// MetaFile is an optional FFMETADATA1 file providing chapters.
+	MetaFile string
+	// Metadata holds container tags as key/value pairs.
+	Metadata [][2]string
+	// SubtitleFile is an optional SubRip file muxed as a mov_text track.
+	SubtitleFile string
+	// VideoFilterFile is an optional filter script; it forces a re-encode.
+	VideoFilterFile string
+	// Transcode is the encoding profile; the zero value stream-copies.
+	Transcode transcodeProfile
+	OutPath   string
+}
+
+const sourceMetadataKey = "camera"
+
+// mergedMetadata tags an output with its wall-clock start and source camera.
+func mergedMetadata(sourceKey string, segs []Segment) [][2]string {
+	md := [][2]string{{"creation_time", segs[0].StartTime.UTC().Format("2006-01-02T15:04:05.000000Z")}}
+	if sourceKey != "" {
+		md = append(md, [2]string{sourceMetadataKey, filepath.ToSlash(sourceKey)})
+	}
+	return md
+}
+
+func mergedOutputName(segs []Segment) string {
+	first := segs[0]
+	last := segs[len(segs)-1]
+	return fmt.Sprintf("%s_%s%s", first.StartTime.Format(tsLayout), last.EndTime.Format(tsLayout), mergedOutExt)
+}
+
+func runFFmpegConcat(job concatJob, lg *logBuffer) error {
+	outPath := job.OutPath
+	args := []string{"-y", "-f", "concat", "-safe", "0", "-i", job.ListFile}
+	input := 1
+	if job.MetaFile != "" {
+		args = append(args, "-f", "ffmetadata", "-i", job.MetaFile, "-map_chapters", strconv.Itoa(input))
+		input++
+	}
+	if job.SubtitleFile != "" {
+		args = append(args, "-i", job.SubtitleFile, "-map", "0:v", "-map", "0:a?", "-map", fmt.Sprintf("%d:s", input))
+		input++
+	}
 	args = append(args, "-fflags", "+genpts")
 	args = append(args, "-c", "copy")
+	if job.SubtitleFile != "" {
+		args = append(args, "-c:s", "mov_text")
+	}
+	switch {
+	case job.VideoFilterFile != "":
+		// The filter script already ends with the profile's scale/fps chain.
+		// -filter_script works on every ffmpeg release, unlike the -/filter
+		// file syntax added in 7.0.
+		args = append(args, "-filter_script:v", job.VideoFilterFile)
+		if job.Transcode.reencodes() {
+			args = append(args, job.Transcode.videoArgs()...)
+		} else {
+			args = append(args, "-c:v", burnVideoCodec, "-preset", burnVideoPreset, "-crf", burnVideoCRF)
+		}
+	case job.Transcode.reencodes():
+		if vf := job.Transcode.videoFilter(); vf != "" {
+			args = append(args, "-vf", vf)
+		}
+		args = append(args, job.Transcode.videoArgs()...)
+	}
+	args = append(args, job.Transcode.audioArgs()...)
 	args = append(args, "-avoid_negative_ts", "make_zero")
+	for _, kv := range job.Metadata {
+		args = append(args, "-metadata", kv[0]+"="+kv[1])
+	}
 	if strings.EqualFold(filepath.Ext(outPath), ".mp4") {
-		args = append(args, "-movflags", "+faststart")
+		// use_metadata_tags keeps custom keys such as the source camera.
+		args = append(args, "-movflags", "+faststart+use_metadata_tags")
 		args = append(args, "-video_track_timescale", fmt.Sprintf("%d", mp4VideoTrackTimebase))
 	}
 	args = append(args, outPath)
-	return runFFmpeg(args)
+	return runFFmpeg(args, lg)
 }
 
-func collectSegments(root, outDir string) ([]Segment, error) {
-	rootAbs := absClean(root)
-	outAbs := absClean(outDir)
+func collectSegments(cfg Config) ([]Segment, error) {
+	rootAbs := absClean(cfg.Dir)
+	outAbs := absClean(cfg.OutDir)
+	quarantineAbs := absClean(cfg.QuarantineDir)
 	segments := make([]Segment, 0, 1024)
-	err := filepath.WalkDir(rootAbs, func(path string, d os.DirEntry, err error) error {
+	var openEnded []Segment
+	err := walkDir(cfg.fs(), rootAbs, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
-			if outAbs != rootAbs && path == outAbs {
+			if path != rootAbs && (path == outAbs || path == quarantineAbs) {
 				return filepath.SkipDir
 			}
 			return nil
 		}
-		base := filepath.Base(path)
-		s, e, ext, ok := parseRawSegment(base)
+		dir := filepath.Dir(path)
+		n, scheme, ok := parseSegmentName(cfg.Schemes, dir, filepath.Base(path))
 		if !ok {
 			return nil
 		}
-		relDir, err := filepath.Rel(rootAbs, filepath.Dir(path))
-		if err != nil {
-			relDir = ""
+		sourceDir := dir
+		for i := 0; i < n.DirDepth; i++ {
+			sourceDir = filepath.Dir(sourceDir)
 		}
-		if relDir == "." {
+		relDir, err := filepath.Rel(rootAbs, sourceDir)
+		if err != nil || relDir == "." || strings.HasPrefix(relDir, "..") {
 			relDir = ""
 		}
-		segments = append(segments, Segment{
+		if n.Camera != "" {
+			relDir = filepath.Join(relDir, n.Camera)
+		}
+		info, err := d.Info()
+		if err != nil {
+			// The file vanished between listing and stat (e.g. camera rotation).
+			return nil
+		}
+		loc := cfg.locationFor(relDir)
+		seg := Segment{
 			Path:      path,
 			SourceKey: relDir,
-			StartTime: s,
-			EndTime:   e,
-			Ext:       ext,
-		})
+			StartTime: wallClockIn(n.Start, loc),
+			Ext:       n.Ext,
+			Scheme:    scheme,
+			DirDepth:  n.DirDepth,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+		}
+		if n.End.IsZero() {
+			openEnded = append(openEnded, seg)
+			return nil
+		}
+		seg.EndTime = wallClockIn(n.End, loc)
+		segments = append(segments, seg)
 		return nil
 	})
-	return segments, err
+	if err != nil {
+		return nil, err
+	}
+	inferEndTimes(cfg.merger(), cfg.Durations, openEnded)
+	segments = append(segments, openEnded...)
+	applyClockOffsets(cfg, segments)
+	return segments, nil
+}
+
+// inferEndTimes fills EndTime for segments whose name carries only a start
+// with the duration the merger probes, capped at the next segment's start.
+// Motion clips are often much shorter than the distance to their successor,
+// so that start is only taken as the end when probing fails and it follows
+// within inferSegmentMaxLen.
+func inferEndTimes(m Merger, cache *durationCache, segs []Segment) {
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].SourceKey != segs[j].SourceKey {
+			return segs[i].SourceKey < segs[j].SourceKey
+		}
+		return segs[i].StartTime.Before(segs[j].StartTime)
+	})
+	for i := range segs {
+		cur := &segs[i]
+		var next time.Time
+		if i+1 < len(segs) && segs[i+1].SourceKey == cur.SourceKey && segs[i+1].StartTime.After(cur.StartTime) {
+			next = segs[i+1].StartTime
+		}
+		d, err := cache.probe(m, *cur)
+		switch {
+		case err == nil:
+			cur.EndTime = cur.StartTime.Add(d)
+			if !next.IsZero() && cur.EndTime.After(next) {
+				cur.EndTime = next
+			}
+		case !next.IsZero() && next.Sub(cur.StartTime) <= inferSegmentMaxLen:
+			logWarn("Cannot probe segment %s (%v); assuming it lasts until the next one", cur.Path, err)
+			cur.EndTime = next
+		default:
+			logWarn("Cannot determine duration of segment %s: %v", cur.Path, err)
+			cur.EndTime = cur.StartTime
+			cur.DurationUnknown = true
+		}
+	}
+}
+
+// durationCache remembers probed segment durations by path, as long as the
+// file keeps its size and modification time.
+type durationCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedDuration
+}
+
+type cachedDuration struct {
+	size     int64
+	modTime  time.Time
+	duration time.Duration
+}
+
+func newDurationCache() *durationCache {
+	return &durationCache{entries: make(map[string]cachedDuration)}
+}
+
+// probe returns the duration of s, probing it with m unless it is cached.
+// Failures are not cached: the file may still be being written. A nil cache
+// always probes.
+func (c *durationCache) probe(m Merger, s Segment) (time.Duration, error) {
+	if c != nil {
+		c.mu.Lock()
+		e, ok := c.entries[s.Path]
+		c.mu.Unlock()
+		if ok && e.size == s.Size && e.modTime.Equal(s.ModTime) {
+			return e.duration, nil
+		}
+	}
+	info, err := m.Probe(s.Path)
+	if err != nil {
+		return 0, err
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.entries[s.Path] = cachedDuration{size: s.Size, modTime: s.ModTime, duration: info.Duration}
+		c.mu.Unlock()
+	}
+	return info.Duration, nil
+}
+
+func dayGroupKey(sourceKey, day string) string {
+	return sourceKey + "|" + day
 }
 
 func groupBySourceAndDay(segs []Segment) map[string]*DayGroup {
 	groups := make(map[string]*DayGroup)
 	for _, s := range segs {
 		day := s.StartTime.Format("20060102")
-		groupKey := s.SourceKey + "|" + day
+		groupKey := dayGroupKey(s.SourceKey, day)
 		g, ok := groups[groupKey]
 		if !ok {
 			g = &DayGroup{Day: day, SourceKey: s.SourceKey}
@@ -299,42 +499,54 @@ func groupBySourceAndDay(segs []Segment) map[string]*DayGroup {
 	return groups
 }
 
-func mergeByDay(cfg Config, onlyYesterday bool) error {
-	segs, err := collectSegments(cfg.Dir, cfg.OutDir)
+func mergeByDay(cfg Config, scheduled bool, state *runState) error {
+	segs, err := collectSegments(cfg)
 	if err != nil {
 		return err
 	}
 	if len(segs) == 0 {
+		state.prune(nil)
 		logInfo("No segments detected; nothing to merge")
 		return nil
 	}
+	if cfg.SplitMidnight {
+		segs = splitAtMidnight(cfg.merger(), segs)
+	}
+	state.prune(groupBySourceAndDay(segs))
 
-	// Merge scope is decided by segment start day.
-	now := time.Now()
-	todayStart := dayStart(now)
-	yesterdayStart := todayStart.AddDate(0, 0, -1)
-	yesterdayDay := yesterdayStart.Format("20060102")
-	todayDay := todayStart.Format("20060102")
+	// Merge scope is decided by segment start day in the source's timezone.
+	now := cfg.clock().Now()
 	segsEligible := make([]Segment, 0, len(segs))
+	catchUp := make(map[string]bool)
 	for _, s := range segs {
+		todayStart := dayStart(now.In(s.StartTime.Location()))
+		yesterdayDay := todayStart.AddDate(0, 0, -1).Format("20060102")
+		todayDay := todayStart.Format("20060102")
 		startDay := s.StartTime.Format("20060102")
-		if onlyYesterday {
-			// Scheduled mode: assign by segment start day.
+		if startDay >= todayDay {
+			continue
+		}
+		if scheduled {
+			// Scheduled mode: yesterday plus days missed or failed since the
+			// last successful run, assigned by segment start day.
 			if startDay != yesterdayDay {
-				continue
+				if !state.pending(s.SourceKey, startDay, s.StartTime.Location()) {
+					continue
+				}
+				catchUp[dayGroupKey(s.SourceKey, startDay)] = true
 			}
 			segsEligible = append(segsEligible, s)
 			continue
 		}
 		// Full rebuild mode: include all days before today by segment start day.
-		if startDay >= todayDay {
-			continue
-		}
 		segsEligible = append(segsEligible, s)
 	}
 	if len(segsEligible) == 0 {
 		return nil
 	}
+	if len(catchUp) > 0 {
+		logInfo("Catching up %d missed or failed source/day group(s) since last success at %s", len(catchUp), state.LastSuccess.Format(time.RFC3339))
+	}
 
 	groups := groupBySourceAndDay(segsEligible)
 	groupKeys := make([]string, 0, len(groups))
@@ -342,63 +554,190 @@ func mergeByDay(cfg Config, onlyYesterday bool) error {
 		groupKeys = append(groupKeys, groupKey)
 	}
 	sort.Strings(groupKeys)
-
-	var mergeErr error
-	successDays := 0
+	ordered := make([]*DayGroup, 0, len(groupKeys))
 	for _, groupKey := range groupKeys {
-		g := groups[groupKey]
-		day := g.Day
-		if len(g.Segments) == 0 {
-			continue
+		if g := groups[groupKey]; len(g.Segments) > 0 {
+			ordered = append(ordered, g)
 		}
-		first := g.Segments[0]
-		last := g.Segments[len(g.Segments)-1]
+	}
 
-		if err := validateExtConsistency(g.Segments); err != nil {
-			logWarn("Skip merge for %s/%s: %v", g.SourceKey, day, err)
-			mergeErr = err
-			continue
+	// Quota is enforced after every group that produced output, reusing this
+	// scan; groups still queued or merging are never touched.
+	quota := newQuotaRun(cfg, state)
+	quota.useScan(segs)
+	quota.markBusy(ordered)
+	return mergeGroups(cfg, ordered, func(g *DayGroup, err error) {
+		state.record(g, err, cfg.clock().Now())
+		quota.finished(g)
+		if err != nil || !g.Rebuilt {
+			return
+		}
+		if err := quota.enforce(); err != nil {
+			logWarn("Cleanup (quota) failed: %v", err)
 		}
+	})
+}
 
-		outName := fmt.Sprintf("%s_%s%s", first.StartTime.Format(tsLayout), last.EndTime.Format(tsLayout), mergedOutExt)
-		outDir := cfg.OutDir
-		if g.SourceKey != "" {
-			outDir = filepath.Join(cfg.OutDir, g.SourceKey)
+// mergeGroup merges one source/day into one or more outputs and removes
+// outputs of that day which are no longer produced.
+func mergeGroup(cfg Config, g *DayGroup, lg *logBuffer) error {
+	day := g.Day
+	if err := validateExtConsistency(g.Segments); err != nil {
+		lg.Warn("Skip merge for %s/%s: %v", g.SourceKey, day, err)
+		return err
+	}
+
+	outDir := sourceOutDir(cfg, g.SourceKey)
+	fingerprint := groupFingerprint(cfg, g)
+	if fingerprintCurrent(cfg.fs(), outDir, day, fingerprint) {
+		lg.Info("Skip merge for source=%s day=%s: merged output is up to date", g.SourceKey, day)
+		ensureDerivedOutputs(cfg, g, outDir, false, lg)
+		return nil
+	}
+	if err := cfg.fs().MkdirAll(outDir, 0o755); err != nil {
+		return fmt.Errorf("Create output directory failed: %w", err)
+	}
+
+	// The readable segments carry their stream format from here on.
+	readable := checkSegments(cfg, g.Segments, lg)
+	if len(readable) == 0 {
+		return fmt.Errorf("no readable segments for source=%s day=%s", g.SourceKey, day)
+	}
+	quarantined := len(readable) != len(g.Segments)
+	g.Segments = readable
+	if quarantined {
+		// Fingerprint what remains so the next run sees the day as current.
+		fingerprint = groupFingerprint(cfg, g)
+	}
+
+	segs, issues := resolveOverlaps(cfg.fs(), cfg.Overlap, g.Segments)
+	logOverlapReport(lg, g, cfg.Overlap, issues)
+
+	runs := [][]Segment{segs}
+	if dominant, mixed := dominantFormat(segs); mixed {
+		logFormatMismatch(lg, g, cfg.Mismatch, segs, dominant)
+		if cfg.Mismatch == mismatchSplit {
+			runs = splitFormatRuns(segs)
 		}
-		outPath := filepath.Join(outDir, outName)
+	}
 
-		if err := os.MkdirAll(outDir, 0o755); err != nil {
-			return fmt.Errorf("Create output directory failed: %w", err)
+	var keepNames []string
+	for _, run := range runs {
+		blocks := [][]Segment{run}
+		var gapChapters []chapter
+		if cfg.GapThreshold > 0 {
+			split := splitAtGaps(run, cfg.GapThreshold)
+			if len(split) > 1 {
+				lg.Info("Detected %d recording gap(s) longer than %s for source=%s day=%s", len(split)-1, cfg.GapThreshold, g.SourceKey, day)
+				if cfg.GapMode == gapModeSplit {
+					blocks = split
+				} else {
+					gapChapters = blockChapters(split)
+				}
+			}
 		}
+		for _, block := range blocks {
+			outName, err := mergeBlock(cfg, g.SourceKey, outDir, block, gapChapters, lg)
+			if err != nil {
+				lg.Error("Merge failed for source=%s day=%s: %v", g.SourceKey, day, err)
+				return err
+			}
+			keepNames = append(keepNames, outName)
+		}
+	}
+	if err := cleanupStaleDailyOutputs(cfg.fs(), outDir, day, keepNames, lg); err != nil {
+		lg.Warn("Cleanup stale merged outputs failed for source=%s day=%s: %v", g.SourceKey, day, err)
+	}
+	if err := writeFingerprint(cfg.fs(), outDir, day, fingerprint, keepNames, segmentsDuration(segs)); err != nil {
+		lg.Warn("Write fingerprint failed for source=%s day=%s: %v", g.SourceKey, day, err)
+	}
+	if cfg.Plan != nil {
+		cfg.Plan.markMerged(g)
+	}
+	g.Rebuilt = true
+	ensureDerivedOutputs(cfg, g, outDir, true, lg)
+	return nil
+}
+
+// ensureDerivedOutputs brings the timelapse, events and thumbnails of a
+// merged day up to date; rebuilt forces them after a fresh merge.
+func ensureDerivedOutputs(cfg Config, g *DayGroup, outDir string, rebuilt bool, lg *logBuffer) {
+	if cfg.Plan != nil {
+		return
+	}
+	ensureTimelapse(cfg, g, outDir, rebuilt, lg)
+	ensureEvents(cfg, g, outDir, rebuilt, lg)
+	ensureThumbnails(cfg, g, outDir, rebuilt, lg)
+}
 
-		listFile, cleanup, err := writeConcatList(g.Segments)
+// mergeBlock concatenates one continuous block into outDir and returns the
+// output file name.
+func mergeBlock(cfg Config, sourceKey, outDir string, block []Segment, gapChapters []chapter, lg *logBuffer) (string, error) {
+	outName := mergedOutputName(block)
+	outPath := filepath.Join(outDir, outName)
+	if cfg.Plan != nil {
+		lg.Info("Dry run: would merge %d segment(s) -> %s", len(block), outPath)
+		cfg.Plan.addMerge(outPath, block)
+		return outName, nil
+	}
+	m := cfg.merger()
+
+	inputs := block
+	if dominant, mixed := dominantFormat(block); mixed && cfg.Mismatch == mismatchReencode {
+		normalized, normCleanup, err := normalizeSegments(cfg.fs(), m, outDir, block, dominant, lg)
 		if err != nil {
-			return fmt.Errorf("Create concat list failed: %w", err)
+			return "", err
 		}
-		defer cleanup()
+		defer normCleanup()
+		inputs = normalized
+	}
 
-		logInfo("Merging %d segment(s) -> %s", len(g.Segments), outPath)
-		if err := runFFmpegConcat(listFile, outPath); err != nil {
-			logError("Merge failed for source=%s day=%s: %v", g.SourceKey, day, err)
-			mergeErr = err
-			continue
-		}
-		if err := cleanupStaleDailyOutputs(outDir, day, outName); err != nil {
-			logWarn("Cleanup stale merged outputs failed for source=%s day=%s: %v", g.SourceKey, day, err)
+	listFile, cleanup, err := writeConcatList(inputs)
+	if err != nil {
+		return "", fmt.Errorf("Create concat list failed: %w", err)
+	}
+	defer cleanup()
+	job := concatJob{
+		ListFile:  listFile,
+		OutPath:   partialPath(outPath),
+		Metadata:  mergedMetadata(sourceKey, block),
+		Transcode: cfg.transcodeFor(sourceKey),
+	}
+	if chapters := outputChapters(cfg, block, gapChapters); len(chapters) > 0 {
+		metaFile, metaCleanup, err := writeChapterMetadata(chapters)
+		if err != nil {
+			return "", fmt.Errorf("Create chapter metadata failed: %w", err)
 		}
-		successDays++
+		defer metaCleanup()
+		job.MetaFile = metaFile
 	}
-	if mergeErr != nil {
-		logWarn("Merging finished with errors; successful days: %d", successDays)
-		return mergeErr
+	tsCleanup, err := prepareTimestamps(cfg.Timestamps, &job, block)
+	if err != nil {
+		return "", fmt.Errorf("Create timestamp track failed: %w", err)
 	}
-	logInfo("Merging finished; successful days: %d", successDays)
+	defer tsCleanup()
 
-	return nil
+	lg.Info("Merging %d segment(s) -> %s", len(block), outPath)
+	fsys := cfg.fs()
+	if err := m.Concat(job, inputs, lg); err != nil {
+		_ = fsys.Remove(job.OutPath)
+		return "", err
+	}
+	if err := commitOutput(fsys, m, job.OutPath, outPath, lg); err != nil {
+		return "", err
+	}
+	if err := writeTimestampSidecar(fsys, cfg.Timestamps, outPath, block); err != nil {
+		lg.Warn("Write timestamp subtitles failed for %s: %v", outPath, err)
+	}
+	return outName, nil
 }
 
-func cleanupStaleDailyOutputs(outDir, day, keepName string) error {
-	entries, err := os.ReadDir(outDir)
+func cleanupStaleDailyOutputs(fsys FileSystem, outDir, day string, keepNames []string, lg *logBuffer) error {
+	keep := make(map[string]bool, len(keepNames))
+	for _, name := range keepNames {
+		keep[name] = true
+	}
+	entries, err := fsys.ReadDir(outDir)
 	if err != nil {
 		return err
 	}
@@ -408,27 +747,28 @@ func cleanupStaleDailyOutputs(outDir, day, keepName string) error {
 			continue
 		}
 		name := e.Name()
-		if name == keepName {
+		if keep[name] {
 			continue
 		}
-		s, _, ext, ok := parseMergedSegment(name)
+		n, ok := mergedScheme{}.Parse(outDir, name)
 		if !ok {
 			continue
 		}
-		if !strings.EqualFold(ext, ".mp4") {
+		if !strings.EqualFold(n.Ext, ".mp4") {
 			continue
 		}
-		if s.Format("20060102") != day {
+		if n.Start.Format("20060102") != day {
 			continue
 		}
-		if err := os.Remove(filepath.Join(outDir, name)); err != nil {
-			logWarn("Failed to remove stale merged output %s: %v", filepath.Join(outDir, name), err)
+		if err := fsys.Remove(filepath.Join(outDir, name)); err != nil {
+			lg.Warn("Failed to remove stale merged output %s: %v", filepath.Join(outDir, name), err)
 			continue
 		}
+		removeCompanions(fsys, filepath.Join(outDir, name), lg)
 		removed++
 	}
 	if removed > 0 {
-		logInfo("Removed %d stale merged output(s) for day=%s in %s", removed, day, outDir)
+		lg.Info("Removed %d stale merged output(s) for day=%s in %s", removed, day, outDir)
 	}
 	return nil
 }
@@ -446,51 +786,69 @@ func validateExtConsistency(segs []Segment) error {
 	return nil
 }
 
-func cleanupOld(cfg Config) error {
+func cleanupOld(cfg Config, state *runState) error {
 	if cfg.Days == nil {
 		logInfo("Cleanup (raw): retention not set, keep forever")
 		return nil
 	}
 
-	dirAbs := absClean(cfg.Dir)
-	outAbs := absClean(cfg.OutDir)
-	now := time.Now()
+	now := cfg.clock().Now()
 	days := *cfg.Days
-	var cutoff time.Time
-	if days == 0 {
-		// Immediate mode: remove finished-day raw segments after merge,
-		// while still keeping today's potentially active recordings.
-		cutoff = dayStart(now)
-	} else {
-		// Natural-day retention to avoid trimming one day incrementally by clock time.
-		cutoff = dayStart(now.AddDate(0, 0, -days))
+	// Cutoffs are natural days in each source's timezone: days=0 removes
+	// finished-day raw segments after merge while keeping today's potentially
+	// active recordings; otherwise whole days are kept rather than trimming
+	// one day incrementally by clock time.
+	cutoffFor := func(loc *time.Location) time.Time {
+		return dayCutoff(now, loc, days)
+	}
+	cutoff := cutoffFor(cfg.locationFor(""))
+	segs, err := collectSegments(cfg)
+	if err != nil {
+		return err
 	}
-	var toDelete []string
-	err := filepath.WalkDir(dirAbs, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			if outAbs != dirAbs && path == outAbs {
-				return filepath.SkipDir
+	if cfg.SplitMidnight {
+		segs = splitAtMidnight(cfg.merger(), segs)
+	}
+	groups := groupBySourceAndDay(segs)
+	verified := make(map[string]bool)
+	// A file split at midnight is only deleted once every piece qualifies.
+	deletable := make(map[string]bool)
+	nestedDirs := make(map[string]bool)
+	for _, s := range segs {
+		ok := !s.DurationUnknown && !s.EndTime.Before(s.StartTime) && s.EndTime.Before(cutoffFor(s.StartTime.Location()))
+		if ok {
+			day := s.StartTime.Format("20060102")
+			groupKey := dayGroupKey(s.SourceKey, day)
+			groupOK, checked := verified[groupKey]
+			if !checked {
+				g := groups[groupKey]
+				// Merged outputs past their own retention are gone by design; the
+				// raw segments of those days no longer need a merged copy, provided
+				// the day is on record as merged.
+				if mergedExpired(cfg, state, g, now) {
+					groupOK = true
+				} else if err := verifyDayMerged(cfg, g); err != nil {
+					logWarn("Cleanup (raw): keep %d segment(s) for source=%s day=%s, not safely merged: %v", len(g.Segments), g.SourceKey, day, err)
+				} else {
+					groupOK = true
+				}
+				verified[groupKey] = groupOK
 			}
-			return nil
+			ok = groupOK
 		}
-		base := filepath.Base(path)
-		s, e, _, ok := parseRawSegment(base)
-		if !ok {
-			return nil
+		if prev, seen := deletable[s.Path]; seen {
+			ok = ok && prev
 		}
-		if e.Before(s) {
-			return nil
+		deletable[s.Path] = ok
+		if s.DirDepth > 0 {
+			nestedDirs[filepath.Dir(s.Path)] = true
 		}
-		if e.Before(cutoff) {
+	}
+	var toDelete []string
+	for path, ok := range deletable {
+		if ok {
 			toDelete = append(toDelete, path)
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 
 	if len(toDelete) == 0 {
@@ -499,21 +857,37 @@ func cleanupOld(cfg Config) error {
 	}
 	sort.Strings(toDelete)
 	logInfo("Cleanup (raw): deleting %d file(s) older than %d days (end < %s)", len(toDelete), days, cutoff.Format(time.RFC3339))
+	fsys := cfg.fs()
 	for _, p := range toDelete {
-		if err := os.Remove(p); err != nil {
+		if err := fsys.Remove(p); err != nil {
 			logWarn("Failed to delete %s: %v", p, err)
 		}
 	}
+	removeEmptyDirs(fsys, nestedDirs)
 	return nil
 }
 
+// removeEmptyDirs drops per-hour (or similar) folders emptied by cleanup.
+func removeEmptyDirs(fsys FileSystem, dirs map[string]bool) {
+	for dir := range dirs {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := fsys.Remove(dir); err != nil {
+			logWarn("Failed to remove empty directory %s: %v", dir, err)
+		}
+	}
+}
+
 func cleanupMerged(cfg Config) error {
 	if cfg.MergedDays == nil {
 		logInfo("Cleanup (merged): retention not set, keep forever")
 		return nil
 	}
 
-	if _, err := os.Stat(cfg.OutDir); err != nil {
+	fsys := cfg.fs()
+	if _, err := fsys.Stat(cfg.OutDir); err != nil {
 		if os.IsNotExist(err) {
 			logInfo("Cleanup (merged): output directory does not exist yet, skip: %s", cfg.OutDir)
 			return nil
@@ -521,31 +895,41 @@ func cleanupMerged(cfg Config) error {
 		return err
 	}
 
+	now := cfg.clock().Now()
 	days := *cfg.MergedDays
-	cutoff := dayStart(time.Now().AddDate(0, 0, -days))
+	cutoff := dayCutoff(now, cfg.locationFor(""), days)
 	var toDelete []string
-	err := filepath.WalkDir(cfg.OutDir, func(path string, d os.DirEntry, err error) error {
+	quarantineAbs := absClean(cfg.QuarantineDir)
+	err := walkDir(fsys, cfg.OutDir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
+			if absClean(path) == quarantineAbs {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		base := filepath.Base(path)
 		if strings.HasPrefix(base, "00_") {
 			return nil
 		}
-		s, e, ext, ok := parseMergedSegment(base)
+		n, ok := mergedScheme{}.Parse(filepath.Dir(path), base)
 		if !ok {
 			return nil
 		}
-		if !strings.EqualFold(ext, ".mp4") {
+		if !strings.EqualFold(n.Ext, ".mp4") {
 			return nil
 		}
-		if e.Before(s) {
+		if n.End.Before(n.Start) {
 			return nil
 		}
-		if e.Before(cutoff) {
+		sourceKey, err := filepath.Rel(cfg.OutDir, filepath.Dir(path))
+		if err != nil || sourceKey == "." {
+			sourceKey = ""
+		}
+		loc := cfg.locationFor(sourceKey)
+		if wallClockIn(n.End, loc).Before(dayCutoff(now, loc, days)) {
 			toDelete = append(toDelete, path)
 		}
 		return nil
@@ -560,9 +944,27 @@ func cleanupMerged(cfg Config) error {
 	sort.Strings(toDelete)
 	logInfo("Cleanup (merged): deleting %d file(s) older than %d days (end < %s)", len(toDelete), days, cutoff.Format(time.RFC3339))
 	for _, p := range toDelete {
-		if err := os.Remove(p); err != nil {
+		if _, err := removeMergedOutput(fsys, p); err != nil {
 			logWarn("Failed to delete merged %s: %v", p, err)
 		}
 	}
 	return nil
 }
+
+// removeMergedOutput deletes a merged output with its companions, the
+// fingerprint and the events of its day, and returns the bytes freed.
+func removeMergedOutput(fsys FileSystem, path string) (int64, error) {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := fsys.Remove(path); err != nil {
+		return 0, err
+	}
+	freed := info.Size() + removeCompanions(fsys, path, nil)
+	if n, ok := (mergedScheme{}).Parse(filepath.Dir(path), filepath.Base(path)); ok {
+		removeFingerprint(fsys, filepath.Dir(path), n.Start.Format("20060102"))
+		freed += removeEvents(fsys, filepath.Dir(path), n.Start.Format("20060102"))
+	}
+	return freed, nil
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("free space is not available on this platform")
+}
+
+func sameVolume(a, b string) bool {
+	return false
+}
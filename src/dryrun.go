@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// dryRunPlan is the FileSystem of --dry-run. Reads go to the host; removals
+// and moves of existing files (quarantine) are recorded with their size and
+// hidden from later reads, so cleanup sees the tree it would leave behind;
+// every other write is dropped. Merges are recorded by mergeBlock instead of
+// being run.
+type dryRunPlan struct {
+	base FileSystem
+
+	mu      sync.Mutex
+	merges  []plannedMerge
+	merged  map[string]bool
+	removed map[string]removedPath
+	moved   map[string]plannedMove
+}
+
+type plannedMove struct {
+	To   string
+	Size int64
+}
+
+type removedPath struct {
+	Size int64
+	Dir  bool
+}
+
+type plannedMerge struct {
+	Output string
+	Inputs []string
+}
+
+func newDryRunPlan(base FileSystem) *dryRunPlan {
+	return &dryRunPlan{base: base, merged: make(map[string]bool), removed: make(map[string]removedPath), moved: make(map[string]plannedMove)}
+}
+
+// addMerge records the output a merge would write and its inputs.
+func (p *dryRunPlan) addMerge(outPath string, inputs []Segment) {
+	paths := make([]string, len(inputs))
+	for i, s := range inputs {
+		paths[i] = s.Path
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.merges = append(p.merges, plannedMerge{Output: outPath, Inputs: paths})
+}
+
+// markMerged records that the group would be merged by this run, so raw
+// cleanup treats it as verified.
+func (p *dryRunPlan) markMerged(g *DayGroup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.merged[dayGroupKey(g.SourceKey, g.Day)] = true
+}
+
+func (p *dryRunPlan) plannedMerged(g *DayGroup) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.merged[dayGroupKey(g.SourceKey, g.Day)]
+}
+
+// hidden reports whether name or one of its parents was removed.
+func (p *dryRunPlan) hidden(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dir := filepath.Clean(name); ; dir = filepath.Dir(dir) {
+		if _, ok := p.removed[dir]; ok {
+			return true
+		}
+		if _, ok := p.moved[dir]; ok {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+func (p *dryRunPlan) Stat(name string) (fs.FileInfo, error) {
+	if p.hidden(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return p.base.Stat(name)
+}
+
+func (p *dryRunPlan) ReadDir(name string) ([]fs.DirEntry, error) {
+	if p.hidden(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := p.base.ReadDir(name)
+	kept := entries[:0]
+	for _, e := range entries {
+		if !p.hidden(filepath.Join(name, e.Name())) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, err
+}
+
+func (p *dryRunPlan) Open(name string) (fs.File, error) {
+	if p.hidden(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return p.base.Open(name)
+}
+
+func (p *dryRunPlan) Create(name string) (io.WriteCloser, error) { return discardCloser{}, nil }
+func (p *dryRunPlan) Sync(name string) error                     { return nil }
+
+// discardCloser swallows what a dry run would have written.
+type discardCloser struct{}
+
+func (discardCloser) Write(b []byte) (int, error) { return len(b), nil }
+func (discardCloser) Close() error                { return nil }
+
+func (p *dryRunPlan) ReadFile(name string) ([]byte, error) {
+	if p.hidden(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return p.base.ReadFile(name)
+}
+
+func (p *dryRunPlan) WriteFile(name string, data []byte, perm fs.FileMode) error { return nil }
+func (p *dryRunPlan) MkdirAll(path string, perm fs.FileMode) error               { return nil }
+
+// MkdirTemp names the directory without creating it; nothing is written
+// into it.
+func (p *dryRunPlan) MkdirTemp(dir, pattern string) (string, error) {
+	return filepath.Join(dir, strings.Replace(pattern, "*", "dryrun", 1)), nil
+}
+
+// Rename records moves of existing files; renames of files this plan never
+// wrote (state and fingerprint updates) are dropped.
+func (p *dryRunPlan) Rename(oldpath, newpath string) error {
+	info, err := p.Stat(oldpath)
+	if err != nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.moved[filepath.Clean(oldpath)] = plannedMove{To: newpath, Size: info.Size()}
+	return nil
+}
+
+func (p *dryRunPlan) Remove(name string) error {
+	info, err := p.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if entries, err := p.ReadDir(name); err != nil || len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	p.record(name, info)
+	return nil
+}
+
+func (p *dryRunPlan) RemoveAll(path string) error {
+	if _, err := p.Stat(path); err != nil {
+		return nil
+	}
+	_ = walkDir(p, path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			p.record(name, info)
+		}
+		return nil
+	})
+	p.record(path, nil)
+	return nil
+}
+
+func (p *dryRunPlan) record(name string, info fs.FileInfo) {
+	r := removedPath{Dir: true}
+	if info != nil && !info.IsDir() {
+		r = removedPath{Size: info.Size()}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removed[filepath.Clean(name)] = r
+}
+
+// print logs the planned merges and deletions.
+func (p *dryRunPlan) print() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	merges := append([]plannedMerge(nil), p.merges...)
+	sort.Slice(merges, func(i, j int) bool { return merges[i].Output < merges[j].Output })
+	logInfo("Dry run: %d merge(s) would be produced, assuming every merge succeeds", len(merges))
+	for _, m := range merges {
+		logInfo("  %s <- %d segment(s)", m.Output, len(m.Inputs))
+		for _, in := range m.Inputs {
+			logInfo("    %s", in)
+		}
+	}
+
+	sources := make([]string, 0, len(p.moved))
+	var movedTotal int64
+	for path, m := range p.moved {
+		sources = append(sources, path)
+		movedTotal += m.Size
+	}
+	sort.Strings(sources)
+	logInfo("Dry run: %d unreadable segment(s) would be moved to quarantine, %s in total", len(sources), formatBytes(movedTotal))
+	for _, path := range sources {
+		logInfo("  %s -> %s (%s)", path, p.moved[path].To, formatBytes(p.moved[path].Size))
+	}
+
+	paths := make([]string, 0, len(p.removed))
+	var total int64
+	for path, r := range p.removed {
+		paths = append(paths, path)
+		total += r.Size
+	}
+	sort.Strings(paths)
+	logInfo("Dry run: %d path(s) would be deleted, %s in total", len(paths), formatBytes(total))
+	for _, path := range paths {
+		if r := p.removed[path]; r.Dir {
+			logInfo("  %s (directory)", path)
+		} else {
+			logInfo("  %s (%s)", path, formatBytes(r.Size))
+		}
+	}
+}
+
+// formatBytes renders n with a binary unit, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
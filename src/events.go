@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventsDirName      = "events"
+	eventsFileName     = "events.json"
+	highlightsFileName = "highlights" + mergedOutExt
+)
+
+// sceneEvent is one scene change, grouped with changes that fall inside the
+// same padded clip.
+type sceneEvent struct {
+	Time   time.Time `json:"time"`
+	Output string    `json:"output"`
+	Offset float64   `json:"offset"`
+	Score  float64   `json:"score"`
+	Clip   string    `json:"clip,omitempty"`
+	// Changes counts the scene changes merged into this event.
+	Changes int `json:"changes"`
+
+	clipStart time.Duration
+	clipEnd   time.Duration
+}
+
+type eventsFile struct {
+	Day       string       `json:"day"`
+	Source    string       `json:"source"`
+	Threshold float64      `json:"threshold"`
+	Events    []sceneEvent `json:"events"`
+}
+
+func eventsEnabled(cfg Config) bool {
+	return cfg.SceneThreshold > 0
+}
+
+// eventsDir is where the events, clips and highlights reel of a day live.
+func eventsDir(outDir, day string) string {
+	return filepath.Join(outDir, eventsDirName, day)
+}
+
+// outputWallClock maps a playback position in a merged output to wall-clock
+// time using the timeline of the segments merged into it. Positions outside
+// the known timeline fall back to the output's start time.
+func outputWallClock(cfg Config, g *DayGroup, outPath string) func(time.Duration) time.Time {
+	n, _ := mergedScheme{}.Parse(filepath.Dir(outPath), filepath.Base(outPath))
+	loc := cfg.locationFor(g.SourceKey)
+	start := wallClockIn(n.Start, loc)
+	end := wallClockIn(n.End, loc)
+	segs, _ := resolveOverlaps(cfg.fs(), cfg.Overlap, g.Segments)
+	var inOutput []Segment
+	for _, s := range segs {
+		if !s.StartTime.Before(start) && !s.EndTime.After(end) {
+			inOutput = append(inOutput, s)
+		}
+	}
+	runs := timelineRuns(inOutput)
+	return func(pos time.Duration) time.Time {
+		for _, r := range runs {
+			if pos >= r.Pos && pos < r.Pos+r.Len {
+				return r.Start.Add(pos - r.Pos)
+			}
+		}
+		return start.Add(pos)
+	}
+}
+
+// ensureEvents runs scene-change detection over the merged outputs of a day
+// and writes padded clips, an events file and optionally a highlights reel.
+// Like timelapses they are rebuilt with the day and failures only logged.
+func ensureEvents(cfg Config, g *DayGroup, outDir string, rebuilt bool, lg *logBuffer) {
+	if !eventsEnabled(cfg) {
+		return
+	}
+	fsys := cfg.fs()
+	dir := eventsDir(outDir, g.Day)
+	if _, err := fsys.Stat(filepath.Join(dir, eventsFileName)); err == nil && !rebuilt {
+		return
+	}
+	outputs, err := mergedOutputsForDay(fsys, outDir, g.Day)
+	if err != nil || len(outputs) == 0 {
+		return
+	}
+	sort.Strings(outputs)
+	if err := fsys.RemoveAll(dir); err != nil {
+		lg.Warn("Remove old events failed for source=%s day=%s: %v", g.SourceKey, g.Day, err)
+		return
+	}
+	if err := fsys.MkdirAll(dir, 0o755); err != nil {
+		lg.Warn("Create events directory failed: %v", err)
+		return
+	}
+
+	var events []sceneEvent
+	for _, out := range outputs {
+		found, err := detectSceneEvents(cfg, out, lg)
+		if err != nil {
+			lg.Warn("Scene detection failed for %s: %v", out, err)
+			return
+		}
+		wall := outputWallClock(cfg, g, out)
+		for i := range found {
+			found[i].Time = wall(time.Duration(found[i].Offset * float64(time.Second)))
+		}
+		events = append(events, found...)
+	}
+
+	var clips []Segment
+	for i := range events {
+		e := &events[i]
+		if e.clipEnd <= e.clipStart {
+			continue
+		}
+		name := "event-" + e.Time.Format(tsLayout) + mergedOutExt
+		if err := writeEventClip(fsys, cfg.merger(), filepath.Join(outDir, e.Output), e.clipStart, e.clipEnd, filepath.Join(dir, name), lg); err != nil {
+			lg.Warn("Export event clip %s failed: %v", name, err)
+			continue
+		}
+		e.Clip = name
+		clips = append(clips, Segment{Path: filepath.Join(dir, name)})
+	}
+	lg.Info("Detected %d event(s) for source=%s day=%s", len(events), g.SourceKey, g.Day)
+
+	if cfg.Highlights && len(clips) > 0 {
+		if err := writeHighlights(fsys, cfg.merger(), clips, filepath.Join(dir, highlightsFileName), lg); err != nil {
+			lg.Warn("Highlights reel failed for source=%s day=%s: %v", g.SourceKey, g.Day, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(eventsFile{Day: g.Day, Source: g.SourceKey, Threshold: cfg.SceneThreshold, Events: events}, "", "  ")
+	if err != nil {
+		return
+	}
+	// Written last: its presence marks the day's events as complete.
+	path := filepath.Join(dir, eventsFileName)
+	tmp := partialPath(path)
+	if err := fsys.WriteFile(tmp, data, 0o644); err != nil {
+		lg.Warn("Write events file failed: %v", err)
+		return
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		_ = fsys.Remove(tmp)
+		lg.Warn("Write events file failed: %v", err)
+	}
+}
+
+// detectSceneEvents returns the scene changes of one merged output with
+// their padded clip windows. Only keyframes are decoded, so changes are
+// measured between consecutive keyframes (typically 1-4s apart); changes
+// whose clips would overlap are merged into one event.
+func detectSceneEvents(cfg Config, outPath string, lg *logBuffer) ([]sceneEvent, error) {
+	m := cfg.merger()
+	changes, err := m.SceneChanges(outPath, cfg.SceneThreshold, lg)
+	if err != nil {
+		return nil, err
+	}
+	info, err := m.Probe(outPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []sceneEvent
+	for _, c := range changes {
+		from := c.pos - cfg.EventPadding
+		if from < 0 {
+			from = 0
+		}
+		to := c.pos + cfg.EventPadding
+		if to > info.Duration {
+			to = info.Duration
+		}
+		if n := len(events); n > 0 && from <= events[n-1].clipEnd {
+			last := &events[n-1]
+			last.clipEnd = to
+			last.Changes++
+			if c.score > last.Score {
+				last.Score = c.score
+			}
+			continue
+		}
+		events = append(events, sceneEvent{
+			Output:    filepath.Base(outPath),
+			Offset:    c.pos.Seconds(),
+			Score:     c.score,
+			Changes:   1,
+			clipStart: from,
+			clipEnd:   to,
+		})
+	}
+	return events, nil
+}
+
+type sceneChange struct {
+	pos   time.Duration
+	score float64
+}
+
+// runSceneDetection has ffmpeg print the scene score of every keyframe
+// above threshold to a temporary file and parses it.
+func runSceneDetection(path string, threshold float64, lg *logBuffer) ([]sceneChange, error) {
+	metaFile, cleanup, err := timestampTempFile("scene_*.txt")
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	filter := fmt.Sprintf("scale=320:-2,select='gt(scene\\,%g)',metadata=print:file=%s",
+		threshold, escapeFilterPath(metaFile))
+	args := []string{"-skip_frame", "nokey", "-i", path, "-an", "-vf", filter, "-f", "null", "-"}
+	if err := runFFmpeg(args, lg); err != nil {
+		return nil, err
+	}
+	return parseSceneMetadata(metaFile)
+}
+
+// parseSceneMetadata reads the output of ffmpeg's metadata=print filter:
+// a "frame:... pts_time:T" line followed by "lavfi.scene_score=S".
+func parseSceneMetadata(path string) ([]sceneChange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var changes []sceneChange
+	var pos time.Duration
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.Index(line, "pts_time:"); i >= 0 {
+			fields := strings.Fields(line[i+len("pts_time:"):])
+			if len(fields) > 0 {
+				if secs, err := strconv.ParseFloat(fields[0], 64); err == nil {
+					pos = time.Duration(secs * float64(time.Second))
+				}
+			}
+			continue
+		}
+		if v, ok := strings.CutPrefix(line, "lavfi.scene_score="); ok {
+			score, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				changes = append(changes, sceneChange{pos: pos, score: score})
+			}
+		}
+	}
+	return changes, sc.Err()
+}
+
+// escapeFilterPath quotes a file path for use as a filter option value.
+func escapeFilterPath(path string) string {
+	return "'" + strings.ReplaceAll(filepath.ToSlash(path), "'", `'\''`) + "'"
+}
+
+func writeEventClip(fsys FileSystem, m Merger, src string, from, to time.Duration, dst string, lg *logBuffer) error {
+	tmp := partialPath(dst)
+	if err := m.Cut(src, from, to, tmp, lg); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, dst)
+}
+
+// cutArgs stream-copies from..to of src; the cut starts on the keyframe
+// before from.
+func cutArgs(src string, from, to time.Duration, dst string) []string {
+	return []string{"-y", "-ss", strconv.FormatFloat(from.Seconds(), 'f', 3, 64), "-i", src,
+		"-t", strconv.FormatFloat((to - from).Seconds(), 'f', 3, 64),
+		"-map", "0:v", "-map", "0:a?", "-c", "copy", "-avoid_negative_ts", "make_zero",
+		"-movflags", "+faststart", dst}
+}
+
+func writeHighlights(fsys FileSystem, m Merger, clips []Segment, dst string, lg *logBuffer) error {
+	listFile, cleanup, err := writeConcatList(clips)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	tmp := partialPath(dst)
+	lg.Info("Writing highlights reel of %d clip(s) -> %s", len(clips), dst)
+	job := concatJob{ListFile: listFile, OutPath: tmp}
+	if err := m.Concat(job, clips, lg); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return commitOutput(fsys, m, tmp, dst, lg)
+}
+
+// removeEvents deletes the events directory of a day, e.g. when its merged
+// output expires, and returns the bytes freed.
+func removeEvents(fsys FileSystem, outDir, day string) int64 {
+	dir := eventsDir(outDir, day)
+	size := treeSize(fsys, dir)
+	if err := fsys.RemoveAll(dir); err != nil {
+		logWarn("Failed to remove events %s: %v", dir, err)
+		return 0
+	}
+	_ = fsys.Remove(filepath.Join(outDir, eventsDirName))
+	return size
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+// memFS is an in-memory FileSystem over absolute slash paths. Like the host
+// it needs parent directories to exist before files are written; seed files
+// with add, which creates them.
+type memFS struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+	temps int
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(fstest.MapFS)}
+}
+
+// memKey maps a host path to its MapFS key.
+func memKey(name string) string {
+	key := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+	if key == "" {
+		return "."
+	}
+	return key
+}
+
+// add writes a file, creating its parent directories.
+func (m *memFS) add(name string, data []byte) {
+	if err := m.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		panic(err)
+	}
+	if err := m.WriteFile(name, data, 0o644); err != nil {
+		panic(err)
+	}
+}
+
+// paths lists every file, sorted.
+func (m *memFS) paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for key, f := range m.files {
+		if !f.Mode.IsDir() {
+			out = append(out, "/"+key)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.Open(memKey(name))
+}
+
+func (m *memFS) Create(name string) (io.WriteCloser, error) {
+	if err := m.checkParent("create", name); err != nil {
+		return nil, err
+	}
+	return &memWriter{fsys: m, name: name}, nil
+}
+
+func (m *memFS) Sync(name string) error {
+	_, err := m.Stat(name)
+	return err
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.Stat(memKey(name))
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.ReadDir(memKey(name))
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.ReadFile(memKey(name))
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := m.checkParent("open", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.files[memKey(name)]; ok && f.Mode.IsDir() {
+		return &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	m.files[memKey(name)] = &fstest.MapFile{Data: bytes.Clone(data), Mode: perm}
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := memKey(path); key != "."; key = memKey("/" + filepath.Dir(key)) {
+		if f, ok := m.files[key]; ok {
+			if !f.Mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		m.files[key] = &fstest.MapFile{Mode: fs.ModeDir | perm}
+	}
+	return nil
+}
+
+func (m *memFS) MkdirTemp(dir, pattern string) (string, error) {
+	if err := m.checkParent("mkdirtemp", filepath.Join(dir, pattern)); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	m.temps++
+	base := pattern + strconv.Itoa(m.temps)
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		base = pattern[:i] + strconv.Itoa(m.temps) + pattern[i+1:]
+	}
+	name := filepath.Join(dir, base)
+	m.mu.Unlock()
+	return name, m.MkdirAll(name, 0o700)
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	if err := m.checkParent("rename", newpath); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := memKey(oldpath), memKey(newpath)
+	moved := make(fstest.MapFS)
+	for key, f := range m.files {
+		if key == from || strings.HasPrefix(key, from+"/") {
+			moved[to+strings.TrimPrefix(key, from)] = f
+			delete(m.files, key)
+		}
+	}
+	if len(moved) == 0 {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	for key, f := range moved {
+		m.files[key] = f
+	}
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memKey(name)
+	if _, err := m.files.Stat(key); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for k := range m.files {
+		if strings.HasPrefix(k, key+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	delete(m.files, key)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memKey(path)
+	for k := range m.files {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.files, k)
+		}
+	}
+	return nil
+}
+
+// checkParent fails like the host does when the directory of name is
+// missing.
+func (m *memFS) checkParent(op, name string) error {
+	dir := filepath.Dir(name)
+	st, err := m.Stat(dir)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !st.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// memWriter stores what was written when closed.
+type memWriter struct {
+	fsys *memFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(b []byte) (int, error) { return w.buf.Write(b) }
+func (w *memWriter) Close() error                { return w.fsys.WriteFile(w.name, w.buf.Bytes(), 0o644) }
+
+func TestWalkDirMatchesFilepath(t *testing.T) {
+	root := t.TempDir()
+	for _, p := range []string{"b/2.mp4", "a/1.mp4", "a/skip/x.mp4", "c.mp4"} {
+		path := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(p), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	collect := func(walk func(fs.WalkDirFunc) error) []string {
+		var seen []string
+		err := walk(func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == "skip" {
+				return filepath.SkipDir
+			}
+			seen = append(seen, path)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seen
+	}
+	want := collect(func(fn fs.WalkDirFunc) error { return filepath.WalkDir(root, fn) })
+	got := collect(func(fn fs.WalkDirFunc) error { return walkDir(osFS{}, root, fn) })
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("walkDir visited\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
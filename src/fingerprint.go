@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A fingerprint records which segments (and merge options) produced the
+// outputs of a source/day, so unchanged days are not merged again.
+type fingerprintFile struct {
+	Day         string   `json:"day"`
+	Fingerprint string   `json:"fingerprint"`
+	Outputs     []string `json:"outputs"`
+	// Expected is the footage duration the outputs were merged from, after
+	// overlap resolution; verification reuses it instead of hashing again.
+	Expected time.Duration `json:"expected,omitempty"`
+}
+
+func fingerprintPath(outDir, day string) string {
+	return filepath.Join(outDir, "."+day+".fingerprint.json")
+}
+
+// mergeOptionsSignature lists the options that change merged output content.
+func mergeOptionsSignature(cfg Config) string {
+	return fmt.Sprintf("gap=%s gapMode=%s chapterHours=%v chapterSegments=%v timestamps=%s splitMidnight=%v overlap=%s mismatch=%s backend=%s",
+		cfg.GapThreshold, cfg.GapMode, cfg.ChapterHours, cfg.ChapterSegments, cfg.Timestamps, cfg.SplitMidnight, cfg.Overlap, cfg.Mismatch, cfg.MergeBackend)
+}
+
+func groupFingerprint(cfg Config, g *DayGroup) string {
+	h := sha256.New()
+	fmt.Fprintln(h, mergeOptionsSignature(cfg))
+	fmt.Fprintln(h, "transcode="+cfg.transcodeFor(g.SourceKey).String())
+	for _, s := range g.Segments {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d\x00%d\x00%d\x00%d\n", s.Path, s.Size, s.ModTime.UnixNano(), s.StartTime.Unix(), s.EndTime.Unix(), s.InPoint, s.OutPoint)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readCurrentFingerprint returns the stored fingerprint of a day when it
+// matches and every recorded output still exists.
+func readCurrentFingerprint(fsys FileSystem, outDir, day, fingerprint string) (fingerprintFile, bool) {
+	var f fingerprintFile
+	data, err := fsys.ReadFile(fingerprintPath(outDir, day))
+	if err != nil {
+		return f, false
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, false
+	}
+	if f.Fingerprint != fingerprint || len(f.Outputs) == 0 {
+		return f, false
+	}
+	for _, name := range f.Outputs {
+		if _, err := fsys.Stat(filepath.Join(outDir, name)); err != nil {
+			return f, false
+		}
+	}
+	return f, true
+}
+
+// fingerprintCurrent reports whether the stored fingerprint matches and every
+// recorded output still exists.
+func fingerprintCurrent(fsys FileSystem, outDir, day, fingerprint string) bool {
+	_, ok := readCurrentFingerprint(fsys, outDir, day, fingerprint)
+	return ok
+}
+
+func writeFingerprint(fsys FileSystem, outDir, day, fingerprint string, outputs []string, expected time.Duration) error {
+	data, err := json.MarshalIndent(fingerprintFile{Day: day, Fingerprint: fingerprint, Outputs: outputs, Expected: expected}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fingerprintPath(outDir, day)
+	tmp := partialPath(path)
+	if err := fsys.WriteFile(tmp, data, 0o644); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, path)
+}
+
+func removeFingerprint(fsys FileSystem, outDir, day string) {
+	if err := fsys.Remove(fingerprintPath(outDir, day)); err != nil && !os.IsNotExist(err) {
+		logWarn("Failed to remove fingerprint %s: %v", fingerprintPath(outDir, day), err)
+	}
+}
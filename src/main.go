@@ -13,29 +13,53 @@ func main() {
 	log.SetFlags(0)
 	log.SetPrefix("")
 	cfg := parseFlags()
+	if cfg.SkewReport {
+		if err := reportSkew(cfg); err != nil {
+			logFatal("Skew report failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.DryRun {
+		cfg.Plan = newDryRunPlan(cfg.fs())
+		cfg.FS = cfg.Plan
+		logInfo("Dry run: planning one run over dir=%s outDir=%s; no file will be changed", cfg.Dir, cfg.OutDir)
+		sweepPartialOutputs(cfg.fs(), cfg.OutDir)
+		err := runOnce(cfg, false)
+		cfg.Plan.print()
+		if err != nil {
+			logFatal("Run failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
 	daemonMode := strings.TrimSpace(cfg.Cron) != ""
-	logInfo("xiaomi-video starting: dir=%s outDir=%s ext=%s rawRetention=%s mergedRetention=%s skipToday=fixed(true) daemon=%v cron='%s'",
-		cfg.Dir, cfg.OutDir, mergedOutExt, optionalDaysText(cfg.Days), optionalDaysText(cfg.MergedDays), daemonMode, cfg.Cron)
+	logInfo("xiaomi-video starting: dir=%s outDir=%s ext=%s schemes=%s gap=%s gapMode=%s transcode=%s rawRetention=%s mergedRetention=%s skipToday=fixed(true) daemon=%v cron='%s'",
+		cfg.Dir, cfg.OutDir, mergedOutExt, schemeNames(cfg.Schemes), cfg.GapThreshold, cfg.GapMode, cfg.Transcode, optionalDaysText(cfg.Days), optionalDaysText(cfg.MergedDays), daemonMode, cfg.Cron)
+
+	sweepPartialOutputs(cfg.fs(), cfg.OutDir)
 
 	if daemonMode {
 		logInfo("Daemon mode enabled by CRON='%s' (TZ=%s)", cfg.Cron, os.Getenv("TZ"))
+		clock := cfg.clock()
 		// First run after startup: rebuild all historical days.
 		if err := runOnce(cfg, false); err != nil {
 			logError("Run failed: %v", err)
 		}
 		for {
-			next, err := nextCronTime(cfg.Cron, time.Now())
+			now := clock.Now()
+			next, err := nextCronTime(cfg.Cron, now)
 			if err != nil {
 				logError("Invalid --cron '%s': %v; fallback to 60s later", cfg.Cron, err)
-				next = time.Now().Add(60 * time.Second)
+				next = now.Add(60 * time.Second)
 			}
-			wait := time.Until(next)
+			wait := next.Sub(now)
 			if wait < 0 {
 				wait = 0
 			}
 			logInfo("Next run at %s (in %s)", next.Format(time.RFC3339), wait.Truncate(time.Second))
-			time.Sleep(wait)
-			// Scheduled runs: only generate yesterday.
+			clock.Sleep(wait)
+			// Scheduled runs: yesterday plus days missed since the last success.
 			if err := runOnce(cfg, true); err != nil {
 				logError("Run failed: %v", err)
 			}
@@ -48,21 +72,48 @@ func main() {
 	}
 }
 
-func runOnce(cfg Config, onlyYesterday bool) error {
-	start := time.Now()
+func runOnce(cfg Config, scheduled bool) error {
+	start := cfg.clock().Now()
+	// Merging, cleanup and quota enforcement each list the segments.
+	cfg.Durations = newDurationCache()
 	logInfo("Run started at %s", start.Format(time.RFC3339))
 	if err := ensureFFmpeg(); err != nil {
-		return fmt.Errorf("FFmpeg not found: %w", err)
+		if cfg.MergeBackend != mergeBackendNative && !cfg.DryRun {
+			return fmt.Errorf("FFmpeg not found: %w", err)
+		}
+		logWarn("FFmpeg not found; only native stream-copy merges are available")
 	}
-	if err := mergeByDay(cfg, onlyYesterday); err != nil {
-		return err
+	if err := ensureFFprobe(); err != nil {
+		// A dry run probes segments too, to plan quarantine moves.
+		if cfg.MergeBackend != mergeBackendNative {
+			return fmt.Errorf("FFprobe not found: %w", err)
+		}
+		logWarn("FFprobe not found; probing MP4 files natively")
+	}
+	state := loadState(cfg)
+	mergeErr := mergeByDay(cfg, scheduled, state)
+	if err := saveState(cfg, state); err != nil {
+		logWarn("Save state file failed: %v", err)
 	}
-	if err := cleanupOld(cfg); err != nil {
+	if mergeErr != nil {
+		return mergeErr
+	}
+	if err := cleanupOld(cfg, state); err != nil {
 		return err
 	}
 	if err := cleanupMerged(cfg); err != nil {
 		return err
 	}
-	logInfo("Run finished in %s", time.Since(start).Truncate(time.Second))
+	if err := cleanupTimelapses(cfg); err != nil {
+		return err
+	}
+	if err := newQuotaRun(cfg, state).enforce(); err != nil {
+		return err
+	}
+	state.LastSuccess = start
+	if err := saveState(cfg, state); err != nil {
+		logWarn("Save state file failed: %v", err)
+	}
+	logInfo("Run finished in %s", cfg.clock().Now().Sub(start).Truncate(time.Second))
 	return nil
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Merger performs the media operations of the merge pipeline and its
+// derived outputs. ffmpegMerger is the default; recordingMerger stands in
+// for it where ffmpeg and real footage are not available. Methods writing
+// dst create only that file; moving it into place is left to the caller.
+type Merger interface {
+	// Probe reports the duration and stream format of a media file.
+	Probe(path string) (mediaInfo, error)
+	// Keyframes lists the file timestamps of the video keyframes, sorted.
+	Keyframes(path string) ([]time.Duration, error)
+	// Concat writes job.OutPath from inputs, which job.ListFile lists.
+	Concat(job concatJob, inputs []Segment, lg *logBuffer) error
+	// Transcode re-encodes one segment to target, honouring its in/out
+	// points, so it can be concatenated with stream copy.
+	Transcode(s Segment, target streamFormat, dst string, lg *logBuffer) error
+	// SceneChanges scores the changes between consecutive keyframes and
+	// returns those above threshold.
+	SceneChanges(path string, threshold float64, lg *logBuffer) ([]sceneChange, error)
+	// Cut stream-copies src from..to into dst.
+	Cut(src string, from, to time.Duration, dst string, lg *logBuffer) error
+	// Timelapse encodes inputs into dst keeping one frame per step.
+	Timelapse(inputs []Segment, step time.Duration, dst string, lg *logBuffer) error
+	// Frame writes the frame of src at a position as a JPEG.
+	Frame(src string, at time.Duration, dst string, lg *logBuffer) error
+	// ContactSheet tiles the labelled frames of src into one JPEG.
+	ContactSheet(src string, frames []sheetFrame, dst string, lg *logBuffer) error
+}
+
+// ffmpegMerger runs merges with ffmpeg and ffprobe, or with the native MP4
+// writer when Backend is native.
+type ffmpegMerger struct {
+	Backend string
+	// Clock stamps native merges whose first segment has no start time.
+	Clock Clock
+}
+
+func (m ffmpegMerger) Probe(path string) (mediaInfo, error) {
+	return probeMedia(path)
+}
+
+func (m ffmpegMerger) Keyframes(path string) ([]time.Duration, error) {
+	return probeKeyframes(path)
+}
+
+// Concat produces a concat job with the configured backend. The native
+// backend hands jobs it cannot handle, or fails on, to ffmpeg.
+func (m ffmpegMerger) Concat(job concatJob, inputs []Segment, lg *logBuffer) error {
+	if m.Backend == mergeBackendNative {
+		reason := nativeUnsupported(job, inputs)
+		if reason == "" {
+			err := nativeConcat(inputs, job.OutPath, job.Metadata, m.Clock.Now())
+			if err == nil {
+				return nil
+			}
+			_ = os.Remove(job.OutPath)
+			lg.Warn("Native merge failed, falling back to ffmpeg: %v", err)
+		} else {
+			lg.Info("Native merge backend cannot %s, using ffmpeg", reason)
+		}
+	}
+	return runFFmpegConcat(job, lg)
+}
+
+func (m ffmpegMerger) Transcode(s Segment, target streamFormat, dst string, lg *logBuffer) error {
+	return runFFmpeg(normalizeArgs(s, target, dst), lg)
+}
+
+func (m ffmpegMerger) SceneChanges(path string, threshold float64, lg *logBuffer) ([]sceneChange, error) {
+	return runSceneDetection(path, threshold, lg)
+}
+
+func (m ffmpegMerger) Cut(src string, from, to time.Duration, dst string, lg *logBuffer) error {
+	return runFFmpeg(cutArgs(src, from, to, dst), lg)
+}
+
+func (m ffmpegMerger) Timelapse(inputs []Segment, step time.Duration, dst string, lg *logBuffer) error {
+	return runTimelapse(inputs, step, dst, lg)
+}
+
+func (m ffmpegMerger) Frame(src string, at time.Duration, dst string, lg *logBuffer) error {
+	return runFFmpeg([]string{"-y", "-ss", seekArg(at), "-i", src, "-frames:v", "1", "-q:v", "3", dst}, lg)
+}
+
+func (m ffmpegMerger) ContactSheet(src string, frames []sheetFrame, dst string, lg *logBuffer) error {
+	return runContactSheet(src, frames, dst, lg)
+}
+
+// merger returns the configured Merger, defaulting to ffmpeg.
+func (cfg Config) merger() Merger {
+	if cfg.Merger != nil {
+		return cfg.Merger
+	}
+	return ffmpegMerger{Backend: cfg.MergeBackend, Clock: cfg.clock()}
+}
@@ -0,0 +1,697 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMediaHeader starts every placeholder written by recordingMerger.
+const fakeMediaHeader = "fake-media duration="
+
+// recordingMerger is an in-memory Merger for driving the merge pipeline
+// without ffmpeg or real footage. It records every call. Concat, Transcode,
+// Cut and Timelapse write a small placeholder to fsys whose probed duration
+// is that of their inputs, so outputs pass verification and can be checked
+// afterwards; Frame and ContactSheet write a placeholder image.
+type recordingMerger struct {
+	fsys FileSystem
+	mu   sync.Mutex
+	// Media holds probe results by path; paths not listed get Default, and a
+	// zero Default makes them unreadable.
+	Media   map[string]mediaInfo
+	Default mediaInfo
+	// Keys and Scenes hold keyframe and scene-change results by path; paths
+	// without keyframes cannot be split, paths without scenes have none.
+	Keys   map[string][]time.Duration
+	Scenes map[string][]sceneChange
+	// Fail makes any call touching the path (input or output) fail.
+	Fail  map[string]error
+	Calls []mergerCall
+}
+
+// mergerCall is one recorded Merger call.
+type mergerCall struct {
+	// Op is the lower-case method name.
+	Op     string
+	Inputs []string
+	Output string
+}
+
+func newRecordingMerger(fsys FileSystem) *recordingMerger {
+	return &recordingMerger{fsys: fsys, Media: make(map[string]mediaInfo), Keys: make(map[string][]time.Duration),
+		Scenes: make(map[string][]sceneChange), Fail: make(map[string]error)}
+}
+
+func (m *recordingMerger) record(op string, inputs []string, output string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Calls = append(m.Calls, mergerCall{Op: op, Inputs: inputs, Output: output})
+	for _, p := range append(inputs, output) {
+		if err := m.Fail[p]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// calls returns the recorded calls of one operation.
+func (m *recordingMerger) calls(op string) []mergerCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []mergerCall
+	for _, c := range m.Calls {
+		if c.Op == op {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (m *recordingMerger) Probe(path string) (mediaInfo, error) {
+	if err := m.record("probe", []string{path}, ""); err != nil {
+		return mediaInfo{}, err
+	}
+	if data, err := m.fsys.ReadFile(path); err == nil {
+		var ns int64
+		if _, err := fmt.Sscanf(string(data), fakeMediaHeader+"%d", &ns); err == nil {
+			return mediaInfo{Duration: time.Duration(ns), HasVideo: true}, nil
+		}
+	}
+	m.mu.Lock()
+	info, ok := m.Media[path]
+	if !ok {
+		info = m.Default
+	}
+	m.mu.Unlock()
+	if info.Duration <= 0 {
+		return mediaInfo{}, errors.New("no media info")
+	}
+	return info, nil
+}
+
+func (m *recordingMerger) Keyframes(path string) ([]time.Duration, error) {
+	if err := m.record("keyframes", []string{path}, ""); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if keys := m.Keys[path]; len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, errors.New("no video keyframes found")
+}
+
+func (m *recordingMerger) Concat(job concatJob, inputs []Segment, lg *logBuffer) error {
+	paths := make([]string, len(inputs))
+	var total time.Duration
+	for i, s := range inputs {
+		paths[i] = s.Path
+		total += m.fakeSegmentDuration(s)
+	}
+	if err := m.record("concat", paths, job.OutPath); err != nil {
+		return err
+	}
+	return m.writeFakeMedia(job.OutPath, total)
+}
+
+func (m *recordingMerger) Transcode(s Segment, target streamFormat, dst string, lg *logBuffer) error {
+	if err := m.record("transcode", []string{s.Path}, dst); err != nil {
+		return err
+	}
+	return m.writeFakeMedia(dst, m.fakeSegmentDuration(s))
+}
+
+func (m *recordingMerger) SceneChanges(path string, threshold float64, lg *logBuffer) ([]sceneChange, error) {
+	if err := m.record("scenechanges", []string{path}, ""); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []sceneChange
+	for _, c := range m.Scenes[path] {
+		if c.score > threshold {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (m *recordingMerger) Cut(src string, from, to time.Duration, dst string, lg *logBuffer) error {
+	if err := m.record("cut", []string{src}, dst); err != nil {
+		return err
+	}
+	return m.writeFakeMedia(dst, to-from)
+}
+
+func (m *recordingMerger) Timelapse(inputs []Segment, step time.Duration, dst string, lg *logBuffer) error {
+	paths := make([]string, len(inputs))
+	var total time.Duration
+	for i, s := range inputs {
+		paths[i] = s.Path
+		total += m.fakeSegmentDuration(s)
+	}
+	if err := m.record("timelapse", paths, dst); err != nil {
+		return err
+	}
+	// One frame per step, played at timelapseFPS.
+	return m.writeFakeMedia(dst, time.Duration(int64(total/step)*int64(time.Second)/timelapseFPS))
+}
+
+func (m *recordingMerger) Frame(src string, at time.Duration, dst string, lg *logBuffer) error {
+	if err := m.record("frame", []string{src}, dst); err != nil {
+		return err
+	}
+	return m.fsys.WriteFile(dst, []byte(fmt.Sprintf("fake-frame at=%s\n", at)), 0o644)
+}
+
+func (m *recordingMerger) ContactSheet(src string, frames []sheetFrame, dst string, lg *logBuffer) error {
+	if err := m.record("contactsheet", []string{src}, dst); err != nil {
+		return err
+	}
+	var labels []string
+	for _, f := range frames {
+		labels = append(labels, f.Label)
+	}
+	return m.fsys.WriteFile(dst, []byte("fake-sheet "+strings.Join(labels, ",")+"\n"), 0o644)
+}
+
+// fakeSegmentDuration is the part of s a real merge would keep. Moving the
+// in-point also moves StartTime, so the wall-clock span already excludes it.
+// Derived outputs such as event clips have no times and are probed instead.
+func (m *recordingMerger) fakeSegmentDuration(s Segment) time.Duration {
+	if s.OutPoint > 0 {
+		return s.OutPoint - s.InPoint
+	}
+	if s.StartTime.IsZero() {
+		info, _ := m.Probe(s.Path)
+		return info.Duration
+	}
+	return s.EndTime.Sub(s.StartTime)
+}
+
+func (m *recordingMerger) writeFakeMedia(path string, d time.Duration) error {
+	return m.fsys.WriteFile(path, []byte(fmt.Sprintf("%s%d\n", fakeMediaHeader, int64(d))), 0o644)
+}
+
+// sourceSegment adds a raw segment of a camera in a subfolder of the input.
+func (f *footageFixture) sourceSegment(source, start, end string) string {
+	path := filepath.Join(testInDir, source, "00_"+start+"_"+end+".mp4")
+	f.fsys.add(path, []byte(start))
+	return path
+}
+
+// concats maps every merged output to the base names of its inputs.
+func (f *footageFixture) concats() map[string][]string {
+	out := make(map[string][]string)
+	for _, c := range f.merger.calls("concat") {
+		var names []string
+		for _, in := range c.Inputs {
+			names = append(names, filepath.Base(in))
+		}
+		out[c.Output] = names
+	}
+	return out
+}
+
+// mergedFiles lists the merged outputs on disk below the output folder.
+func (f *footageFixture) mergedFiles() []string {
+	var out []string
+	for _, p := range f.fsys.paths() {
+		if strings.HasPrefix(p, testOutDir+"/") && filepath.Ext(p) == mergedOutExt && !strings.HasPrefix(filepath.Base(p), ".") {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+type testSegment struct{ source, start, end string }
+
+func TestMergeByDayGrouping(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []testSegment
+		gap      time.Duration
+		gapMode  string
+		// want maps each output to the segments merged into it, by start.
+		want map[string][]string
+	}{
+		{
+			name: "one output per source and day, today left alone",
+			segments: []testSegment{
+				{"", "20240310080000", "20240310081000"},
+				{"", "20240310081000", "20240310082000"},
+				{"", "20240311230000", "20240311231000"},
+				{"garage", "20240310090000", "20240310091000"},
+				{"", "20240312080000", "20240312081000"},
+			},
+			want: map[string][]string{
+				"/cam/out/20240310080000_20240310082000.mp4":        {"20240310080000", "20240310081000"},
+				"/cam/out/20240311230000_20240311231000.mp4":        {"20240311230000"},
+				"/cam/out/garage/20240310090000_20240310091000.mp4": {"20240310090000"},
+			},
+		},
+		{
+			name: "gaps split a day",
+			segments: []testSegment{
+				{"", "20240310080000", "20240310081000"},
+				{"", "20240310081000", "20240310082000"},
+				{"", "20240310090000", "20240310091000"},
+			},
+			gap: 5 * time.Minute, gapMode: gapModeSplit,
+			want: map[string][]string{
+				"/cam/out/20240310080000_20240310082000.mp4": {"20240310080000", "20240310081000"},
+				"/cam/out/20240310090000_20240310091000.mp4": {"20240310090000"},
+			},
+		},
+		{
+			name: "gaps as chapters keep one output",
+			segments: []testSegment{
+				{"", "20240310080000", "20240310081000"},
+				{"", "20240310090000", "20240310091000"},
+			},
+			gap: 5 * time.Minute, gapMode: gapModeChapters,
+			want: map[string][]string{
+				"/cam/out/20240310080000_20240310091000.mp4": {"20240310080000", "20240310090000"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFootageFixture(time.UTC)
+			f.merger.Default = mediaInfo{Duration: 10 * time.Minute, HasVideo: true}
+			for _, s := range tt.segments {
+				f.sourceSegment(s.source, s.start, s.end)
+			}
+			cfg := f.config(f.at("20240312100000"))
+			cfg.GapThreshold = tt.gap
+			cfg.GapMode = tt.gapMode
+			state := &runState{Days: make(map[string]*dayState)}
+			if err := mergeByDay(cfg, false, state); err != nil {
+				t.Fatal(err)
+			}
+
+			var want []string
+			for out := range tt.want {
+				want = append(want, out)
+			}
+			sort.Strings(want)
+			if got := f.mergedFiles(); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("outputs %v, want %v", got, want)
+			}
+			concats := f.concats()
+			for out, starts := range tt.want {
+				inputs := concats[partialPath(out)]
+				if len(inputs) != len(starts) {
+					t.Errorf("%s merged %v, want segments starting %v", out, inputs, starts)
+					continue
+				}
+				for i, start := range starts {
+					if !strings.HasPrefix(inputs[i], "00_"+start+"_") {
+						t.Errorf("%s merged %v, want segments starting %v", out, inputs, starts)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMergeByDayRemovesStaleOutputs(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	f.merger.Default = mediaInfo{Duration: 10 * time.Minute, HasVideo: true}
+	f.segment("20240310080000", "20240310081000")
+	// Left over from an earlier merge of the same day with other segments.
+	stale := filepath.Join(testOutDir, "20240310070000_20240310075000.mp4")
+	staleSubs := filepath.Join(testOutDir, "20240310070000_20240310075000.srt")
+	timelapse := filepath.Join(testOutDir, "20240310070000_20240310075000"+timelapseSuffix)
+	otherDay := filepath.Join(testOutDir, "20240309070000_20240309075000.mp4")
+	for _, p := range []string{stale, staleSubs, timelapse, otherDay} {
+		f.fsys.add(p, []byte("old"))
+	}
+
+	cfg := f.config(f.at("20240312100000"))
+	if err := mergeByDay(cfg, false, &runState{Days: make(map[string]*dayState)}); err != nil {
+		t.Fatal(err)
+	}
+	fresh := filepath.Join(testOutDir, "20240310080000_20240310081000.mp4")
+	got := remaining(f.fsys, fresh, stale, staleSubs, timelapse, otherDay)
+	// Timelapses have their own retention; other days are not touched.
+	want := []string{filepath.Base(fresh), filepath.Base(timelapse), filepath.Base(otherDay)}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestMergeByDayAggregatesErrors(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	f.merger.Default = mediaInfo{Duration: 10 * time.Minute, HasVideo: true}
+	f.segment("20240310080000", "20240310081000")
+	f.segment("20240311080000", "20240311081000")
+	f.sourceSegment("garage", "20240310080000", "20240310081000")
+	failed := []string{
+		filepath.Join(testOutDir, "20240310080000_20240310081000.mp4"),
+		filepath.Join(testOutDir, "garage", "20240310080000_20240310081000.mp4"),
+	}
+	for _, out := range failed {
+		f.merger.Fail[partialPath(out)] = errors.New("disk full")
+	}
+
+	cfg := f.config(f.at("20240312100000"))
+	state := &runState{Days: make(map[string]*dayState)}
+	err := mergeByDay(cfg, false, state)
+	if err == nil {
+		t.Fatal("mergeByDay succeeded, want the failed days reported")
+	}
+	for _, want := range []string{"source= day=20240310: disk full", "source=garage day=20240310: disk full"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+
+	wantStatus := map[string]string{
+		dayGroupKey("", "20240310"):       dayStatusFailed,
+		dayGroupKey("garage", "20240310"): dayStatusFailed,
+		dayGroupKey("", "20240311"):       dayStatusMerged,
+	}
+	for key, status := range wantStatus {
+		if ds := state.Days[key]; ds == nil || ds.Status != status {
+			t.Errorf("state of %s is %+v, want %s", key, ds, status)
+		}
+	}
+	want := []string{filepath.Join(testOutDir, "20240311080000_20240311081000.mp4")}
+	if got := f.mergedFiles(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("outputs %v, want %v", got, want)
+	}
+	for _, p := range f.fsys.paths() {
+		if isPartialName(filepath.Base(p)) {
+			t.Errorf("partial output %s left behind", p)
+		}
+	}
+}
+
+// openCountingFS counts the files opened below a directory.
+type openCountingFS struct {
+	*memFS
+	dir   string
+	opens int
+}
+
+func (c *openCountingFS) Open(name string) (fs.File, error) {
+	if strings.HasPrefix(name, c.dir+"/") {
+		c.opens++
+	}
+	return c.memFS.Open(name)
+}
+
+// Same-size segments are only hashed to drop duplicates, and verification
+// reuses what the merge covered instead of reading the footage again.
+func TestOverlapHashingIsNotRepeated(t *testing.T) {
+	for _, policy := range []string{overlapKeep, overlapDrop} {
+		t.Run(policy, func(t *testing.T) {
+			f := newFootageFixture(time.UTC)
+			f.merger.Default = mediaInfo{Duration: 10 * time.Minute, HasVideo: true}
+			// Every fixture segment holds 14 bytes, so all of them share a size.
+			paths := []string{
+				f.segment("20240310080000", "20240310081000"),
+				f.segment("20240310081000", "20240310082000"),
+			}
+			counting := &openCountingFS{memFS: f.fsys, dir: testInDir}
+			cfg := f.config(f.at("20240312100000"))
+			cfg.FS = counting
+			cfg.Overlap = policy
+			state := &runState{Days: make(map[string]*dayState)}
+			if err := mergeByDay(cfg, false, state); err != nil {
+				t.Fatal(err)
+			}
+			merged := counting.opens
+			if policy == overlapKeep && merged != 0 {
+				t.Errorf("merge opened %d segments under keep", merged)
+			}
+
+			cfg.Days = intPtr(0)
+			if err := cleanupOld(cfg, state); err != nil {
+				t.Fatal(err)
+			}
+			if counting.opens != merged {
+				t.Errorf("verification opened %d segments", counting.opens-merged)
+			}
+			if got := remaining(f.fsys, paths...); len(got) != 0 {
+				t.Errorf("kept %v after a verified merge", got)
+			}
+		})
+	}
+}
+
+func TestCollectSegmentsInfersLegacyEndTimes(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	legacy := func(mmss string, d time.Duration) string {
+		path := filepath.Join(testInDir, "2024031008", mmss+"_1710057900.mp4")
+		f.fsys.add(path, []byte(mmss))
+		if d > 0 {
+			f.merger.Media[path] = mediaInfo{Duration: d, HasVideo: true}
+		}
+		return path
+	}
+	// A short motion clip, one running into its successor, and two that
+	// cannot be probed, the first followed closely by another.
+	short := legacy("05M00S", 30*time.Second)
+	long := legacy("06M00S", 90*time.Second)
+	unreadable := legacy("07M00S", 0)
+	last := legacy("09M00S", 0)
+	want := map[string]string{
+		short:      "20240310080530",
+		long:       "20240310080700",
+		unreadable: "20240310080900",
+		last:       "20240310080900",
+	}
+
+	cfg := f.config(f.at("20240312100000"))
+	cfg.Durations = newDurationCache()
+	for pass := 0; pass < 2; pass++ {
+		segs, err := collectSegments(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segs) != len(want) {
+			t.Fatalf("collected %d segments, want %d", len(segs), len(want))
+		}
+		for _, s := range segs {
+			if got := s.EndTime.Format(tsLayout); got != want[s.Path] {
+				t.Errorf("%s ends at %s, want %s", filepath.Base(s.Path), got, want[s.Path])
+			}
+			if s.DurationUnknown != (s.Path == last) {
+				t.Errorf("%s DurationUnknown=%v", filepath.Base(s.Path), s.DurationUnknown)
+			}
+		}
+	}
+	probes := make(map[string]int)
+	for _, c := range f.merger.calls("probe") {
+		probes[c.Inputs[0]]++
+	}
+	// Durations are probed once per run; failed probes are retried.
+	for path, n := range map[string]int{short: 1, long: 1, unreadable: 2, last: 2} {
+		if probes[path] != n {
+			t.Errorf("%s probed %d times, want %d", filepath.Base(path), probes[path], n)
+		}
+	}
+}
+
+func TestMergeByDaySplitsMismatchedFormats(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	hd := streamFormat{VideoCodec: "h264", Width: 1920, Height: 1080, FrameRate: "20/1", PixFmt: "yuv420p"}
+	sd := hd
+	sd.Width, sd.Height = 640, 360
+	for _, s := range []struct {
+		start, end string
+		format     streamFormat
+	}{
+		{"20240310080000", "20240310081000", hd},
+		{"20240310081000", "20240310082000", sd},
+		{"20240310082000", "20240310083000", sd},
+	} {
+		f.merger.Media[f.segment(s.start, s.end)] = mediaInfo{Duration: 10 * time.Minute, HasVideo: true, Format: s.format}
+	}
+	cfg := f.config(f.at("20240312100000"))
+	cfg.Mismatch = mismatchSplit
+	if err := mergeByDay(cfg, false, &runState{Days: make(map[string]*dayState)}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(testOutDir, "20240310080000_20240310081000.mp4"),
+		filepath.Join(testOutDir, "20240310081000_20240310083000.mp4"),
+	}
+	if got := f.mergedFiles(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("outputs %v, want one per format run %v", got, want)
+	}
+}
+
+func TestMergeByDayReencodesMismatchedSegments(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	hd := streamFormat{VideoCodec: "h264", Width: 1920, Height: 1080, FrameRate: "20/1", PixFmt: "yuv420p"}
+	sd := hd
+	sd.Width, sd.Height = 640, 360
+	for _, s := range []struct {
+		start, end string
+		format     streamFormat
+	}{
+		{"20240310080000", "20240310081000", hd},
+		{"20240310081000", "20240310082000", sd},
+		{"20240310082000", "20240310083000", hd},
+	} {
+		f.merger.Media[f.segment(s.start, s.end)] = mediaInfo{Duration: 10 * time.Minute, HasVideo: true, Format: s.format}
+	}
+	cfg := f.config(f.at("20240312100000"))
+	cfg.Mismatch = mismatchReencode
+	if err := mergeByDay(cfg, false, &runState{Days: make(map[string]*dayState)}); err != nil {
+		t.Fatal(err)
+	}
+
+	transcodes := f.merger.calls("transcode")
+	if len(transcodes) != 3 {
+		t.Fatalf("%d transcodes, want every segment re-encoded", len(transcodes))
+	}
+	tmpDir := filepath.Dir(transcodes[0].Output)
+	if filepath.Dir(tmpDir) != testOutDir || !isPartialName(filepath.Base(tmpDir)) {
+		t.Errorf("re-encoded into %s, want a partial directory in the output folder", tmpDir)
+	}
+	out := filepath.Join(testOutDir, "20240310080000_20240310083000.mp4")
+	concat := f.concats()[partialPath(out)]
+	if len(concat) != 3 || concat[0] != "00000.ts" {
+		t.Errorf("concatenated %v, want the re-encoded segments", concat)
+	}
+	if _, err := f.fsys.Stat(tmpDir); err == nil {
+		t.Errorf("%s left behind", tmpDir)
+	}
+	if got := f.mergedFiles(); len(got) != 1 || got[0] != out {
+		t.Errorf("outputs %v, want %s", got, out)
+	}
+}
+
+func TestMergeByDaySplitsAtMidnight(t *testing.T) {
+	tests := []struct {
+		name string
+		keys bool
+		// want maps each output to its probed duration.
+		want map[string]time.Duration
+	}{
+		// Keyframes every 7s: the first at or after midnight is at 301s.
+		{name: "cut on the first keyframe after midnight", keys: true, want: map[string]time.Duration{
+			"/cam/out/20240310235500_20240311000001.mp4": 301 * time.Second,
+			"/cam/out/20240311000001_20240311001500.mp4": 899 * time.Second,
+		}},
+		{name: "kept in the first day without keyframes", want: map[string]time.Duration{
+			"/cam/out/20240310235500_20240311000500.mp4": 10 * time.Minute,
+			"/cam/out/20240311000500_20240311001500.mp4": 10 * time.Minute,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFootageFixture(time.UTC)
+			f.merger.Default = mediaInfo{Duration: 10 * time.Minute, HasVideo: true}
+			overnight := f.segment("20240310235500", "20240311000500")
+			f.segment("20240311000500", "20240311001500")
+			if tt.keys {
+				for k := time.Duration(0); k < 10*time.Minute; k += 7 * time.Second {
+					f.merger.Keys[overnight] = append(f.merger.Keys[overnight], k)
+				}
+			}
+			cfg := f.config(f.at("20240312100000"))
+			cfg.SplitMidnight = true
+			if err := mergeByDay(cfg, false, &runState{Days: make(map[string]*dayState)}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := f.mergedFiles()
+			if len(got) != len(tt.want) {
+				t.Fatalf("outputs %v, want %d", got, len(tt.want))
+			}
+			for _, out := range got {
+				want, ok := tt.want[out]
+				if !ok {
+					t.Errorf("unexpected output %s", out)
+					continue
+				}
+				if info, err := f.merger.Probe(out); err != nil || info.Duration != want {
+					t.Errorf("%s lasts %s (%v), want %s", out, info.Duration, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeByDayWritesDerivedOutputs(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	f.merger.Default = mediaInfo{Duration: 10 * time.Minute, HasVideo: true}
+	f.segment("20240310080000", "20240310081000")
+	f.segment("20240310081000", "20240310082000")
+	out := filepath.Join(testOutDir, "20240310080000_20240310082000.mp4")
+	f.merger.Scenes[out] = []sceneChange{
+		{pos: 60 * time.Second, score: 0.5},
+		// Its clip overlaps the previous one, so both form one event.
+		{pos: 62 * time.Second, score: 0.6},
+		{pos: 600 * time.Second, score: 0.1},
+		{pos: 900 * time.Second, score: 0.4},
+	}
+	cfg := f.config(f.at("20240312100000"))
+	cfg.TimelapseSpeed = 60
+	cfg.SceneThreshold = 0.3
+	cfg.EventPadding = 5 * time.Second
+	cfg.Highlights = true
+	cfg.ThumbnailInterval = 5 * time.Minute
+	if err := mergeByDay(cfg, false, &runState{Days: make(map[string]*dayState)}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := eventsDir(testOutDir, "20240310")
+	want := []string{
+		filepath.Join(testOutDir, "20240310080000_20240310082000-contactsheet.jpg"),
+		filepath.Join(testOutDir, "20240310080000_20240310082000-poster.jpg"),
+		out,
+		filepath.Join(testOutDir, "20240310080000_20240310082000"+timelapseSuffix),
+		filepath.Join(events, "event-20240310080100.mp4"),
+		filepath.Join(events, "event-20240310081500.mp4"),
+		filepath.Join(events, eventsFileName),
+		filepath.Join(events, highlightsFileName),
+	}
+	var got []string
+	for _, p := range f.fsys.paths() {
+		if strings.HasPrefix(p, testOutDir+"/") && !strings.HasPrefix(filepath.Base(p), ".") {
+			got = append(got, p)
+		}
+	}
+	sort.Strings(want)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("output folder holds\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	clip, err := f.merger.Probe(filepath.Join(events, "event-20240310080100.mp4"))
+	if err != nil || clip.Duration != 12*time.Second {
+		t.Errorf("first clip lasts %s (%v), want 12s padded around both changes", clip.Duration, err)
+	}
+	if highlights := f.merger.calls("concat"); len(highlights) != 2 || len(highlights[1].Inputs) != 2 {
+		t.Errorf("concats %+v, want the merge and a reel of both clips", highlights)
+	}
+	sheet, err := f.fsys.ReadFile(filepath.Join(testOutDir, "20240310080000_20240310082000-contactsheet.jpg"))
+	if wantSheet := "fake-sheet 2024-03-10 08:00:00,2024-03-10 08:05:00,2024-03-10 08:10:00,2024-03-10 08:15:00\n"; err != nil || string(sheet) != wantSheet {
+		t.Errorf("contact sheet %q (%v), want %q", sheet, err, wantSheet)
+	}
+	data, err := f.fsys.ReadFile(filepath.Join(events, eventsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ef eventsFile
+	if err := json.Unmarshal(data, &ef); err != nil {
+		t.Fatal(err)
+	}
+	if len(ef.Events) != 2 || ef.Events[0].Changes != 2 || ef.Events[0].Score != 0.6 {
+		t.Errorf("events %+v, want two with the first merging two changes", ef.Events)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// splitAtMidnight cuts segments that run past midnight into one piece per
+// day. Cuts are placed on the first keyframe at or after midnight so both
+// pieces can be stream-copied: the earlier day ends on that keyframe (at most
+// one GOP past 24:00) and the later day starts cleanly on it.
+func splitAtMidnight(m Merger, segs []Segment) []Segment {
+	out := make([]Segment, 0, len(segs))
+	for _, s := range segs {
+		out = append(out, splitSegmentAtMidnight(m, s)...)
+	}
+	return out
+}
+
+func splitSegmentAtMidnight(m Merger, s Segment) []Segment {
+	if !s.EndTime.After(dayStart(s.StartTime).AddDate(0, 0, 1)) {
+		return []Segment{s}
+	}
+	keys, err := m.Keyframes(s.Path)
+	if err != nil {
+		logWarn("Cannot split %s at midnight, keeping it in day %s: %v", s.Path, s.StartTime.Format("20060102"), err)
+		return []Segment{s}
+	}
+	var pieces []Segment
+	// File timestamp of the piece's first frame.
+	fileStart := keys[0]
+	for {
+		midnight := dayStart(s.StartTime).AddDate(0, 0, 1)
+		if !s.EndTime.After(midnight) {
+			break
+		}
+		target := fileStart + midnight.Sub(s.StartTime)
+		cut := time.Duration(-1)
+		for _, k := range keys {
+			if k >= target {
+				cut = k
+				break
+			}
+		}
+		if cut < 0 || !s.StartTime.Add(cut-fileStart).Before(s.EndTime) {
+			break
+		}
+		head := s
+		head.EndTime = s.StartTime.Add(cut - fileStart)
+		head.OutPoint = cut
+		pieces = append(pieces, head)
+
+		s.StartTime = head.EndTime
+		s.InPoint = cut
+		fileStart = cut
+	}
+	return append(pieces, s)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	mismatchSplit    = "split"
+	mismatchReencode = "reencode"
+)
+
+// streamFormat holds the stream parameters that must match for segments to
+// be concatenated with stream copy.
+type streamFormat struct {
+	VideoCodec string
+	Width      int
+	Height     int
+	FrameRate  string
+	PixFmt     string
+	AudioCodec string
+	SampleRate string
+	Channels   int
+}
+
+func (f streamFormat) String() string {
+	v := fmt.Sprintf("%s %dx%d@%s %s", f.VideoCodec, f.Width, f.Height, f.FrameRate, f.PixFmt)
+	if f.AudioCodec == "" {
+		return v + ", no audio"
+	}
+	return fmt.Sprintf("%s, %s %sHz %dch", v, f.AudioCodec, f.SampleRate, f.Channels)
+}
+
+// dominantFormat returns the format covering the most recorded time and
+// whether any segment differs from it.
+func dominantFormat(segs []Segment) (streamFormat, bool) {
+	total := make(map[streamFormat]time.Duration)
+	var best streamFormat
+	for _, s := range segs {
+		total[s.Format] += s.EndTime.Sub(s.StartTime)
+		if total[s.Format] > total[best] {
+			best = s.Format
+		}
+	}
+	return best, len(total) > 1
+}
+
+// splitFormatRuns splits segments into consecutive runs of equal format.
+func splitFormatRuns(segs []Segment) [][]Segment {
+	var runs [][]Segment
+	for i, s := range segs {
+		if i == 0 || s.Format != segs[i-1].Format {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], s)
+	}
+	return runs
+}
+
+func logFormatMismatch(lg *logBuffer, g *DayGroup, mode string, segs []Segment, dominant streamFormat) {
+	var odd []Segment
+	for _, s := range segs {
+		if s.Format != dominant {
+			odd = append(odd, s)
+		}
+	}
+	lg.Warn("Stream format mismatch for source=%s day=%s: %d of %d segment(s) differ from %s, mode=%s",
+		g.SourceKey, g.Day, len(odd), len(segs), dominant, mode)
+	for _, s := range odd {
+		lg.Info("  %s: %s", s.Path, s.Format)
+	}
+}
+
+// normalizeSegments re-encodes every segment to H.264 (and AAC when target
+// has audio) at the target resolution and frame rate, as MPEG-TS files in a
+// hidden directory under outDir, so the results can be concatenated with
+// stream copy. The returned segments point at the normalised files.
+func normalizeSegments(fsys FileSystem, m Merger, outDir string, segs []Segment, target streamFormat, lg *logBuffer) ([]Segment, func(), error) {
+	tmpDir, err := fsys.MkdirTemp(outDir, ".normalize"+partialMarker+".*")
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("Create normalize directory failed: %w", err)
+	}
+	cleanup := func() {
+		_ = fsys.RemoveAll(tmpDir)
+	}
+	lg.Info("Re-encoding %d segment(s) to %s", len(segs), target)
+	out := make([]Segment, 0, len(segs))
+	for i, s := range segs {
+		dst := filepath.Join(tmpDir, fmt.Sprintf("%05d.ts", i))
+		if err := m.Transcode(s, target, dst, lg); err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("Re-encode %s failed: %w", s.Path, err)
+		}
+		n := s
+		n.Path = dst
+		n.Ext = ".ts"
+		n.InPoint = 0
+		n.OutPoint = 0
+		out = append(out, n)
+	}
+	return out, cleanup, nil
+}
+
+func normalizeArgs(s Segment, target streamFormat, dst string) []string {
+	args := []string{"-y"}
+	if s.InPoint > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(s.InPoint.Seconds(), 'f', 6, 64))
+	}
+	if s.OutPoint > 0 {
+		args = append(args, "-to", strconv.FormatFloat(s.OutPoint.Seconds(), 'f', 6, 64))
+	}
+	args = append(args, "-i", s.Path)
+	silence := target.AudioCodec != "" && s.Format.AudioCodec == ""
+	if silence {
+		layout := "stereo"
+		if target.Channels == 1 {
+			layout = "mono"
+		}
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("anullsrc=r=%s:cl=%s", target.SampleRate, layout))
+	}
+	args = append(args, "-map", "0:v:0")
+	switch {
+	case target.AudioCodec == "":
+	case silence:
+		args = append(args, "-map", "1:a:0", "-shortest")
+	default:
+		args = append(args, "-map", "0:a:0")
+	}
+	filter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+		target.Width, target.Height, target.Width, target.Height)
+	if target.FrameRate != "" && target.FrameRate != "0/0" {
+		filter += ",fps=" + target.FrameRate
+	}
+	args = append(args, "-vf", filter+",format=yuv420p", "-c:v", burnVideoCodec, "-preset", burnVideoPreset, "-crf", burnVideoCRF)
+	if target.AudioCodec == "" {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", "aac", "-ar", target.SampleRate, "-ac", strconv.Itoa(target.Channels))
+	}
+	return append(args, "-f", "mpegts", dst)
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A minimal ISO BMFF (MP4) reader for progressive, single-description
+// files as written by cameras: enough to list every sample of every track
+// with its file offset, size, timing and sync flag, and to copy the sample
+// descriptions verbatim. Fragmented files are not supported.
+
+// mp4Epoch is the zero time of MP4 creation/modification times.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type mp4Box struct {
+	Type string
+	// Data is the payload after the box header.
+	Data []byte
+}
+
+type mp4Sample struct {
+	Offset int64
+	Size   uint32
+	Delta  uint32
+	CTS    int32
+	Sync   bool
+}
+
+type mp4Track struct {
+	ID        uint32
+	Handler   string
+	Timescale uint32
+	Language  uint16
+	Width     uint32
+	Height    uint32
+	Volume    uint16
+	// Raw boxes copied to the output unchanged.
+	Hdlr     []byte
+	MediaHdr []byte
+	Dinf     []byte
+	Stsd     []byte
+	HasCTS   bool
+	HasSync  bool
+	Samples  []mp4Sample
+	Duration uint64
+	// EditOffset is the media time at which presentation starts, from an
+	// edit list of a single normal-rate edit (typically the composition
+	// offset of B-frames). ComplexEdit is set for any other edit list.
+	EditOffset  int64
+	ComplexEdit bool
+}
+
+type mp4File struct {
+	Path           string
+	MovieTimescale uint32
+	MovieDuration  uint64
+	Tracks         []*mp4Track
+}
+
+// readBoxHeader reads the box header at off and returns type, header length
+// and total size; size 0 (to end of file) is resolved against end.
+func readBoxHeader(r io.ReaderAt, off, end int64) (string, int64, int64, error) {
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:8], off); err != nil {
+		return "", 0, 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[:4]))
+	typ := string(hdr[4:8])
+	hdrLen := int64(8)
+	switch size {
+	case 0:
+		size = end - off
+	case 1:
+		if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+			return "", 0, 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		hdrLen = 16
+	}
+	if size < hdrLen || off+size > end {
+		return "", 0, 0, fmt.Errorf("invalid %q box size %d at offset %d", typ, size, off)
+	}
+	return typ, hdrLen, size, nil
+}
+
+// parseBoxes splits a payload into its child boxes.
+func parseBoxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		typ := string(data[4:8])
+		hdrLen := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated box header")
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			hdrLen = 16
+		}
+		if size < hdrLen || size > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid %q box size %d", typ, size)
+		}
+		boxes = append(boxes, mp4Box{Type: typ, Data: data[hdrLen:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) (mp4Box, bool) {
+	for _, b := range boxes {
+		if b.Type == typ {
+			return b, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// rawBox re-serialises a parsed box so it can be copied to another file.
+func rawBox(b mp4Box) []byte {
+	return mp4BoxBytes(b.Type, b.Data)
+}
+
+// mp4Reader reads big-endian fields from a payload and remembers the first
+// out-of-range access.
+type mp4Reader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *mp4Reader) take(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		if r.err == nil {
+			r.err = errors.New("truncated box")
+		}
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *mp4Reader) u8() uint8   { return r.take(1)[0] }
+func (r *mp4Reader) u16() uint16 { return binary.BigEndian.Uint16(r.take(2)) }
+func (r *mp4Reader) u32() uint32 { return binary.BigEndian.Uint32(r.take(4)) }
+func (r *mp4Reader) u64() uint64 { return binary.BigEndian.Uint64(r.take(8)) }
+func (r *mp4Reader) skip(n int)  { r.take(n) }
+
+// entries reads a table's entry count and checks that that many entries of
+// size bytes fit in the rest of the payload, so a corrupt count fails
+// instead of driving a huge allocation or loop.
+func (r *mp4Reader) entries(size int) int {
+	n := r.u32()
+	if r.err == nil && uint64(n)*uint64(size) > uint64(len(r.data)-r.pos) {
+		r.err = fmt.Errorf("%d entries of %d bytes exceed the box", n, size)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// fullBox reads the version and flags of a full box.
+func (r *mp4Reader) fullBox() (uint8, uint32) {
+	v := r.u32()
+	return uint8(v >> 24), v & 0xffffff
+}
+
+func readMP4(path string) (*mp4File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := st.Size()
+	var moov []byte
+	for off := int64(0); off < end; {
+		typ, hdrLen, size, err := readBoxHeader(f, off, end)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case "moof":
+			return nil, errors.New("fragmented MP4 is not supported")
+		case "moov":
+			moov = make([]byte, size-hdrLen)
+			if _, err := f.ReadAt(moov, off+hdrLen); err != nil {
+				return nil, err
+			}
+		}
+		off += size
+	}
+	if moov == nil {
+		return nil, errors.New("moov box not found")
+	}
+	return parseMoov(path, moov, end)
+}
+
+// parseMoov parses the movie box of a file of fileSize bytes.
+func parseMoov(path string, data []byte, fileSize int64) (*mp4File, error) {
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	mf := &mp4File{Path: path}
+	mvhd, ok := findBox(boxes, "mvhd")
+	if !ok {
+		return nil, errors.New("mvhd box not found")
+	}
+	r := &mp4Reader{data: mvhd.Data}
+	if v, _ := r.fullBox(); v == 1 {
+		r.skip(16)
+		mf.MovieTimescale = r.u32()
+		mf.MovieDuration = r.u64()
+	} else {
+		r.skip(8)
+		mf.MovieTimescale = r.u32()
+		mf.MovieDuration = uint64(r.u32())
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("mvhd: %w", r.err)
+	}
+	for _, b := range boxes {
+		if b.Type != "trak" {
+			continue
+		}
+		t, err := parseTrak(b.Data, fileSize)
+		if err != nil {
+			return nil, fmt.Errorf("trak: %w", err)
+		}
+		mf.Tracks = append(mf.Tracks, t)
+	}
+	if len(mf.Tracks) == 0 {
+		return nil, errors.New("no tracks")
+	}
+	return mf, nil
+}
+
+func parseTrak(data []byte, fileSize int64) (*mp4Track, error) {
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	t := &mp4Track{}
+	tkhd, ok := findBox(boxes, "tkhd")
+	if !ok {
+		return nil, errors.New("tkhd box not found")
+	}
+	r := &mp4Reader{data: tkhd.Data}
+	if v, _ := r.fullBox(); v == 1 {
+		r.skip(16)
+		t.ID = r.u32()
+		r.skip(12)
+	} else {
+		r.skip(8)
+		t.ID = r.u32()
+		r.skip(8)
+	}
+	r.skip(8 + 2 + 2)
+	t.Volume = r.u16()
+	r.skip(2 + 36)
+	t.Width = r.u32()
+	t.Height = r.u32()
+	if r.err != nil {
+		return nil, fmt.Errorf("tkhd: %w", r.err)
+	}
+
+	if edts, ok := findBox(boxes, "edts"); ok {
+		if err := parseEdts(t, edts.Data); err != nil {
+			return nil, fmt.Errorf("edts: %w", err)
+		}
+	}
+
+	mdia, ok := findBox(boxes, "mdia")
+	if !ok {
+		return nil, errors.New("mdia box not found")
+	}
+	mdiaBoxes, err := parseBoxes(mdia.Data)
+	if err != nil {
+		return nil, err
+	}
+	mdhd, ok := findBox(mdiaBoxes, "mdhd")
+	if !ok {
+		return nil, errors.New("mdhd box not found")
+	}
+	r = &mp4Reader{data: mdhd.Data}
+	if v, _ := r.fullBox(); v == 1 {
+		r.skip(16)
+		t.Timescale = r.u32()
+		r.skip(8)
+	} else {
+		r.skip(8)
+		t.Timescale = r.u32()
+		r.skip(4)
+	}
+	t.Language = r.u16()
+	if r.err != nil || t.Timescale == 0 {
+		return nil, errors.New("invalid mdhd")
+	}
+	hdlr, ok := findBox(mdiaBoxes, "hdlr")
+	if !ok || len(hdlr.Data) < 12 {
+		return nil, errors.New("hdlr box not found")
+	}
+	t.Hdlr = rawBox(hdlr)
+	t.Handler = string(hdlr.Data[8:12])
+
+	minf, ok := findBox(mdiaBoxes, "minf")
+	if !ok {
+		return nil, errors.New("minf box not found")
+	}
+	minfBoxes, err := parseBoxes(minf.Data)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range minfBoxes {
+		switch b.Type {
+		case "vmhd", "smhd", "nmhd", "sthd", "hmhd":
+			t.MediaHdr = rawBox(b)
+		case "dinf":
+			t.Dinf = rawBox(b)
+		}
+	}
+	stbl, ok := findBox(minfBoxes, "stbl")
+	if !ok {
+		return nil, errors.New("stbl box not found")
+	}
+	if err := parseStbl(t, stbl.Data, fileSize); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseEdts reads the edit list of a track. Only a single edit at normal
+// rate maps to EditOffset; empty edits, several edits or other rates mark
+// the list as complex.
+func parseEdts(t *mp4Track, data []byte) error {
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		return err
+	}
+	elst, ok := findBox(boxes, "elst")
+	if !ok {
+		return nil
+	}
+	r := &mp4Reader{data: elst.Data}
+	v, _ := r.fullBox()
+	size := 12
+	if v == 1 {
+		size = 20
+	}
+	n := r.entries(size)
+	for i := 0; i < n && r.err == nil; i++ {
+		var mediaTime int64
+		if v == 1 {
+			r.skip(8)
+			mediaTime = int64(r.u64())
+		} else {
+			r.skip(4)
+			mediaTime = int64(int32(r.u32()))
+		}
+		rate := r.u32()
+		if n > 1 || mediaTime < 0 || rate != 0x10000 {
+			t.ComplexEdit = true
+			continue
+		}
+		t.EditOffset = mediaTime
+	}
+	return r.err
+}
+
+// parseStbl expands the sample tables into one entry per sample. Entry
+// counts are checked against the box payload, and the samples of a
+// fixed-size table against fileSize, before anything is allocated.
+func parseStbl(t *mp4Track, data []byte, fileSize int64) error {
+	boxes, err := parseBoxes(data)
+	if err != nil {
+		return err
+	}
+	stsd, ok := findBox(boxes, "stsd")
+	if !ok {
+		return errors.New("stsd box not found")
+	}
+	r := &mp4Reader{data: stsd.Data}
+	r.fullBox()
+	if n := r.u32(); n != 1 {
+		return fmt.Errorf("%d sample descriptions (only 1 is supported)", n)
+	}
+	t.Stsd = rawBox(stsd)
+
+	// Sample sizes.
+	var sizes []uint32
+	if b, ok := findBox(boxes, "stsz"); ok {
+		r := &mp4Reader{data: b.Data}
+		r.fullBox()
+		fixed := r.u32()
+		var count int
+		if fixed == 0 {
+			count = r.entries(4)
+		} else if n := r.u32(); uint64(n)*uint64(fixed) > uint64(fileSize) {
+			return fmt.Errorf("stsz: %d samples of %d bytes exceed the file", n, fixed)
+		} else {
+			count = int(n)
+		}
+		if r.err != nil {
+			return fmt.Errorf("stsz: %w", r.err)
+		}
+		sizes = make([]uint32, count)
+		for i := range sizes {
+			if fixed != 0 {
+				sizes[i] = fixed
+			} else {
+				sizes[i] = r.u32()
+			}
+		}
+		if r.err != nil {
+			return fmt.Errorf("stsz: %w", r.err)
+		}
+	} else {
+		return errors.New("stsz box not found (stz2 is not supported)")
+	}
+	t.Samples = make([]mp4Sample, len(sizes))
+	for i := range t.Samples {
+		t.Samples[i].Size = sizes[i]
+		t.Samples[i].Sync = true
+	}
+
+	// Decoding time deltas.
+	b, ok := findBox(boxes, "stts")
+	if !ok {
+		return errors.New("stts box not found")
+	}
+	r = &mp4Reader{data: b.Data}
+	r.fullBox()
+	i := 0
+	for n := r.entries(8); n > 0 && r.err == nil; n-- {
+		count, delta := r.u32(), r.u32()
+		for ; count > 0 && i < len(t.Samples); count-- {
+			t.Samples[i].Delta = delta
+			t.Duration += uint64(delta)
+			i++
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("stts: %w", r.err)
+	}
+
+	if b, ok := findBox(boxes, "ctts"); ok {
+		t.HasCTS = true
+		r := &mp4Reader{data: b.Data}
+		r.fullBox()
+		i := 0
+		for n := r.entries(8); n > 0 && r.err == nil; n-- {
+			count, off := r.u32(), int32(r.u32())
+			for ; count > 0 && i < len(t.Samples); count-- {
+				t.Samples[i].CTS = off
+				i++
+			}
+		}
+		if r.err != nil {
+			return fmt.Errorf("ctts: %w", r.err)
+		}
+	}
+
+	if b, ok := findBox(boxes, "stss"); ok {
+		t.HasSync = true
+		for i := range t.Samples {
+			t.Samples[i].Sync = false
+		}
+		r := &mp4Reader{data: b.Data}
+		r.fullBox()
+		for n := r.entries(4); n > 0 && r.err == nil; n-- {
+			if s := int(r.u32()); s >= 1 && s <= len(t.Samples) {
+				t.Samples[s-1].Sync = true
+			}
+		}
+		if r.err != nil {
+			return fmt.Errorf("stss: %w", r.err)
+		}
+	}
+
+	// Chunk offsets, then samples per chunk.
+	var chunks []int64
+	if b, ok := findBox(boxes, "stco"); ok {
+		r := &mp4Reader{data: b.Data}
+		r.fullBox()
+		n := r.entries(4)
+		chunks = make([]int64, 0, n)
+		for ; n > 0 && r.err == nil; n-- {
+			chunks = append(chunks, int64(r.u32()))
+		}
+		if r.err != nil {
+			return fmt.Errorf("stco: %w", r.err)
+		}
+	} else if b, ok := findBox(boxes, "co64"); ok {
+		r := &mp4Reader{data: b.Data}
+		r.fullBox()
+		n := r.entries(8)
+		chunks = make([]int64, 0, n)
+		for ; n > 0 && r.err == nil; n-- {
+			chunks = append(chunks, int64(r.u64()))
+		}
+		if r.err != nil {
+			return fmt.Errorf("co64: %w", r.err)
+		}
+	} else {
+		return errors.New("chunk offset box not found")
+	}
+	b, ok = findBox(boxes, "stsc")
+	if !ok {
+		return errors.New("stsc box not found")
+	}
+	type stscEntry struct{ first, perChunk uint32 }
+	var stsc []stscEntry
+	r = &mp4Reader{data: b.Data}
+	r.fullBox()
+	for n := r.entries(12); n > 0 && r.err == nil; n-- {
+		first, per := r.u32(), r.u32()
+		r.skip(4)
+		stsc = append(stsc, stscEntry{first, per})
+	}
+	if r.err != nil {
+		return fmt.Errorf("stsc: %w", r.err)
+	}
+	// stsc entries are in ascending order of their first chunk.
+	i = 0
+	e := -1
+	for c := range chunks {
+		for e+1 < len(stsc) && uint32(c+1) >= stsc[e+1].first {
+			e++
+		}
+		per := uint32(0)
+		if e >= 0 {
+			per = stsc[e].perChunk
+		}
+		off := chunks[c]
+		for ; per > 0 && i < len(t.Samples); per-- {
+			t.Samples[i].Offset = off
+			off += int64(t.Samples[i].Size)
+			i++
+		}
+	}
+	if i != len(t.Samples) {
+		return fmt.Errorf("chunk tables cover %d of %d samples", i, len(t.Samples))
+	}
+	return nil
+}
+
+// sampleEntry returns the type and payload of the single sample description.
+func (t *mp4Track) sampleEntry() (string, []byte) {
+	boxes, err := parseBoxes(t.Stsd)
+	if err != nil || len(boxes) == 0 || len(boxes[0].Data) < 8 {
+		return "", nil
+	}
+	// The stsd payload starts with version/flags and the entry count.
+	entries, err := parseBoxes(boxes[0].Data[8:])
+	if err != nil || len(entries) == 0 {
+		return "", nil
+	}
+	return entries[0].Type, entries[0].Data
+}
+
+var mp4CodecNames = map[string]string{
+	"avc1": "h264", "avc3": "h264",
+	"hvc1": "hevc", "hev1": "hevc",
+	"av01": "av1",
+	"mp4a": "aac",
+}
+
+// probeMP4 reads media information from the MP4 boxes, used when ffprobe
+// is not installed. Pixel format is not available this way.
+func probeMP4(path string) (mediaInfo, error) {
+	var info mediaInfo
+	mf, err := readMP4(path)
+	if err != nil {
+		return info, err
+	}
+	if mf.MovieTimescale > 0 {
+		info.Duration = time.Duration(float64(mf.MovieDuration) / float64(mf.MovieTimescale) * float64(time.Second))
+	}
+	for _, t := range mf.Tracks {
+		typ, entry := t.sampleEntry()
+		codec := mp4CodecNames[typ]
+		if codec == "" {
+			codec = typ
+		}
+		if d := time.Duration(float64(t.Duration) / float64(t.Timescale) * float64(time.Second)); d > info.Duration {
+			info.Duration = d
+		}
+		switch t.Handler {
+		case "vide":
+			if info.HasVideo {
+				continue
+			}
+			info.HasVideo = true
+			info.Format.VideoCodec = codec
+			r := &mp4Reader{data: entry}
+			r.skip(24)
+			info.Format.Width = int(r.u16())
+			info.Format.Height = int(r.u16())
+			info.Format.FrameRate = trackFrameRate(t)
+		case "soun":
+			if info.Format.AudioCodec != "" {
+				continue
+			}
+			info.Format.AudioCodec = codec
+			r := &mp4Reader{data: entry}
+			r.skip(16)
+			info.Format.Channels = int(r.u16())
+			r.skip(6)
+			info.Format.SampleRate = strconv.Itoa(int(r.u32() >> 16))
+		}
+	}
+	return info, nil
+}
+
+// trackFrameRate returns timescale/most-common-delta as a reduced fraction.
+func trackFrameRate(t *mp4Track) string {
+	counts := make(map[uint32]int)
+	var best uint32
+	for _, s := range t.Samples {
+		counts[s.Delta]++
+		if counts[s.Delta] > counts[best] {
+			best = s.Delta
+		}
+	}
+	if best == 0 {
+		return "0/0"
+	}
+	g := gcd32(t.Timescale, best)
+	return fmt.Sprintf("%d/%d", t.Timescale/g, best/g)
+}
+
+func gcd32(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// mp4Keyframes lists the presentation times of the first video track's
+// sync samples, used when ffprobe is not installed.
+func mp4Keyframes(path string) ([]time.Duration, error) {
+	mf, err := readMP4(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range mf.Tracks {
+		if t.Handler != "vide" {
+			continue
+		}
+		var keys []time.Duration
+		var dts uint64
+		for _, s := range t.Samples {
+			if s.Sync {
+				pts := int64(dts) + int64(s.CTS)
+				keys = append(keys, time.Duration(float64(pts)/float64(t.Timescale)*float64(time.Second)))
+			}
+			dts += uint64(s.Delta)
+		}
+		if len(keys) == 0 {
+			return nil, errors.New("no keyframes found")
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		return keys, nil
+	}
+	return nil, errors.New("no video track")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// testStbl builds a one-sample sample table, replacing the box of type
+// override when given.
+func testStbl(override []byte) []byte {
+	boxes := map[string][]byte{
+		"stsd": mp4FullBox("stsd", 0, 0, u32s(1), mp4BoxBytes("avc1", make([]byte, 78))),
+		"stts": mp4FullBox("stts", 0, 0, u32s(1, 1, 512)),
+		"stss": mp4FullBox("stss", 0, 0, u32s(1, 1)),
+		"stsc": mp4FullBox("stsc", 0, 0, u32s(1, 1, 1, 1)),
+		"stsz": mp4FullBox("stsz", 0, 0, u32s(0, 1, 100)),
+		"stco": mp4FullBox("stco", 0, 0, u32s(1, 48)),
+	}
+	if override != nil {
+		typ := string(override[4:8])
+		if typ == "co64" {
+			delete(boxes, "stco")
+		}
+		boxes[typ] = override
+	}
+	var parts [][]byte
+	for _, typ := range []string{"stsd", "stts", "ctts", "stss", "stsc", "stsz", "stco", "co64"} {
+		if b, ok := boxes[typ]; ok {
+			parts = append(parts, b)
+		}
+	}
+	return mp4BoxBytes("stbl", parts...)[8:]
+}
+
+func TestParseStblRejectsCorruptCounts(t *testing.T) {
+	const huge = 0xffffffff
+	tests := []struct {
+		name string
+		box  []byte
+		want string
+	}{
+		{name: "valid", want: ""},
+		{name: "stsz count", box: mp4FullBox("stsz", 0, 0, u32s(0, huge, 100)), want: "stsz"},
+		{name: "stsz fixed size", box: mp4FullBox("stsz", 0, 0, u32s(100, huge)), want: "stsz"},
+		{name: "stts count", box: mp4FullBox("stts", 0, 0, u32s(huge, 1, 512)), want: "stts"},
+		{name: "ctts count", box: mp4FullBox("ctts", 0, 0, u32s(huge, 1, 0)), want: "ctts"},
+		{name: "stss count", box: mp4FullBox("stss", 0, 0, u32s(huge, 1)), want: "stss"},
+		{name: "stco count", box: mp4FullBox("stco", 0, 0, u32s(huge, 48)), want: "stco"},
+		{name: "co64 count", box: mp4FullBox("co64", 0, 0, u32s(huge, 0, 48)), want: "co64"},
+		{name: "stsc count", box: mp4FullBox("stsc", 0, 0, u32s(huge, 1, 1, 1)), want: "stsc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseStbl(&mp4Track{}, testStbl(tt.box), 4096)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("parseStbl: %v", err)
+			case tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)):
+				t.Fatalf("parseStbl error %v, want a %s error", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	mergeBackendFFmpeg = "ffmpeg"
+	mergeBackendNative = "native"
+
+	// Output samples are grouped into chunks of about this much media time
+	// and chunks of all tracks are interleaved by start time.
+	mp4ChunkDuration  = time.Second
+	mp4MovieTimescale = 1000
+)
+
+// outSample is a sample of the concatenated output and where to read it.
+type outSample struct {
+	File   int32
+	Offset int64
+	Size   uint32
+	Delta  uint32
+	CTS    int32
+	Sync   bool
+}
+
+type outTrack struct {
+	ref     *mp4Track
+	samples []outSample
+	// chunks holds the index of the first sample of every chunk.
+	chunks  []int
+	offsets []uint64
+	dur     uint64
+	hasCTS  bool
+	hasSync bool
+}
+
+// nativeUnsupported returns why a concat job needs ffmpeg, or "" when the
+// native backend can produce it.
+func nativeUnsupported(job concatJob, inputs []Segment) string {
+	switch {
+	case job.MetaFile != "":
+		return "write chapters"
+	case job.SubtitleFile != "":
+		return "mux a subtitle track"
+	case job.VideoFilterFile != "" || job.Transcode.reencodes() || (job.Transcode.Audio != "" && job.Transcode.Audio != audioCopy):
+		return "re-encode"
+	}
+	for _, s := range inputs {
+		if !strings.EqualFold(filepath.Ext(s.Path), mergedOutExt) {
+			return "read " + filepath.Ext(s.Path) + " files"
+		}
+	}
+	return ""
+}
+
+// nativeConcat stream-copies MP4 segments into one faststart MP4 without
+// ffmpeg. All inputs must carry the same tracks with byte-identical sample
+// descriptions (same codec parameters) and the same edit list offset, which
+// the output carries over; InPoint/OutPoint are honoured with video cut on
+// keyframes. created dates the movie when the first input has
+// no start time.
+func nativeConcat(inputs []Segment, outPath string, metadata [][2]string, created time.Time) error {
+	if len(inputs) == 0 {
+		return errors.New("no inputs")
+	}
+	files := make([]*mp4File, len(inputs))
+	for i, s := range inputs {
+		mf, err := readMP4(s.Path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", s.Path, err)
+		}
+		for ti, t := range mf.Tracks {
+			// Empty or multiple edits would shift tracks against each other
+			// once the files are joined.
+			if t.ComplexEdit {
+				return fmt.Errorf("%s: track %d has an edit list that cannot be carried over", s.Path, ti+1)
+			}
+		}
+		if i > 0 {
+			if err := compatibleMP4(files[0], mf); err != nil {
+				return fmt.Errorf("%s: %w", s.Path, err)
+			}
+		}
+		files[i] = mf
+	}
+
+	tracks := make([]*outTrack, len(files[0].Tracks))
+	for i, t := range files[0].Tracks {
+		tracks[i] = &outTrack{ref: t}
+	}
+	// Every track of a file is padded to the file's longest track so audio
+	// and video stay in sync across thousands of segments.
+	var elapsed float64
+	for fi, mf := range files {
+		var span float64
+		in := videoStart(mf, inputs[fi].InPoint)
+		selected := make([][]mp4Sample, len(tracks))
+		for ti, t := range mf.Tracks {
+			selected[ti] = selectSamples(t, in, inputs[fi].OutPoint)
+			var d uint64
+			for _, s := range selected[ti] {
+				d += uint64(s.Delta)
+			}
+			span = math.Max(span, float64(d)/float64(t.Timescale))
+		}
+		elapsed += span
+		for ti, ot := range tracks {
+			t := mf.Tracks[ti]
+			ot.hasCTS = ot.hasCTS || t.HasCTS
+			ot.hasSync = ot.hasSync || t.HasSync
+			for _, s := range selected[ti] {
+				ot.samples = append(ot.samples, outSample{File: int32(fi), Offset: s.Offset, Size: s.Size, Delta: s.Delta, CTS: s.CTS, Sync: s.Sync})
+				ot.dur += uint64(s.Delta)
+			}
+			if n := len(ot.samples); n > 0 {
+				if target := uint64(math.Round(elapsed * float64(t.Timescale))); target > ot.dur {
+					ot.samples[n-1].Delta += uint32(target - ot.dur)
+					ot.dur = target
+				}
+			}
+		}
+	}
+
+	chunks := planChunks(tracks)
+	var dataSize uint64
+	for _, c := range chunks {
+		dataSize += c.size
+	}
+	ftyp := mp4Ftyp()
+	if !inputs[0].StartTime.IsZero() {
+		created = inputs[0].StartTime
+	}
+	mdatHdr := uint64(8)
+	if dataSize+8 > math.MaxUint32 {
+		mdatHdr = 16
+	}
+	// 64-bit chunk offsets once the data may end past 4 GiB; the margin
+	// covers ftyp and moov. The moov size depends only on offset width.
+	co64 := dataSize > math.MaxUint32-(1<<28)
+	moov := buildMoov(tracks, created, metadata, co64)
+	assignOffsets(chunks, tracks, uint64(len(ftyp)+len(moov))+mdatHdr)
+	moov = buildMoov(tracks, created, metadata, co64)
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(out, 1<<20)
+	if err := writeMP4(w, ftyp, moov, mdatHdr, dataSize, chunks, tracks, inputs); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// compatibleMP4 checks that b can be appended to a stream-copied a.
+func compatibleMP4(a, b *mp4File) error {
+	if len(a.Tracks) != len(b.Tracks) {
+		return fmt.Errorf("track count %d differs from %d", len(b.Tracks), len(a.Tracks))
+	}
+	for i := range a.Tracks {
+		ta, tb := a.Tracks[i], b.Tracks[i]
+		switch {
+		case ta.Handler != tb.Handler:
+			return fmt.Errorf("track %d is %s, not %s", i+1, tb.Handler, ta.Handler)
+		case ta.Timescale != tb.Timescale:
+			return fmt.Errorf("track %d timescale %d differs from %d", i+1, tb.Timescale, ta.Timescale)
+		case !bytes.Equal(ta.Stsd, tb.Stsd):
+			return fmt.Errorf("track %d codec parameters differ", i+1)
+		case ta.EditOffset != tb.EditOffset:
+			return fmt.Errorf("track %d edit list offset %d differs from %d", i+1, tb.EditOffset, ta.EditOffset)
+		}
+	}
+	return nil
+}
+
+// videoStart returns the decode time of the first video keyframe at or after
+// in, so all tracks of a trimmed file start together on that keyframe.
+func videoStart(mf *mp4File, in time.Duration) time.Duration {
+	if in <= 0 {
+		return 0
+	}
+	for _, t := range mf.Tracks {
+		if t.Handler != "vide" {
+			continue
+		}
+		inTicks := uint64(in.Seconds() * float64(t.Timescale))
+		var dts uint64
+		for _, s := range t.Samples {
+			if dts >= inTicks && s.Sync {
+				return time.Duration(float64(dts) / float64(t.Timescale) * float64(time.Second))
+			}
+			dts += uint64(s.Delta)
+		}
+		return in
+	}
+	return in
+}
+
+// selectSamples returns the samples decoded between in and out (zero = to
+// the end). Video starts on the first keyframe at or after in.
+func selectSamples(t *mp4Track, in, out time.Duration) []mp4Sample {
+	if in <= 0 && out <= 0 {
+		return t.Samples
+	}
+	inTicks := uint64(in.Seconds() * float64(t.Timescale))
+	outTicks := uint64(math.MaxUint64)
+	if out > 0 {
+		outTicks = uint64(out.Seconds() * float64(t.Timescale))
+	}
+	first, last := -1, len(t.Samples)
+	var dts uint64
+	for i, s := range t.Samples {
+		if first < 0 && dts+1 >= inTicks && (s.Sync || t.Handler != "vide") {
+			first = i
+		}
+		if dts >= outTicks {
+			last = i
+			break
+		}
+		dts += uint64(s.Delta)
+	}
+	if first < 0 || first >= last {
+		return nil
+	}
+	return t.Samples[first:last]
+}
+
+type mp4Chunk struct {
+	track int
+	first int
+	count int
+	start float64
+	size  uint64
+}
+
+// planChunks splits each track into chunks of about mp4ChunkDuration and
+// orders all chunks by start time for interleaved output.
+func planChunks(tracks []*outTrack) []*mp4Chunk {
+	var chunks []*mp4Chunk
+	for ti, t := range tracks {
+		limit := uint64(mp4ChunkDuration.Seconds() * float64(t.ref.Timescale))
+		var dts, chunkDur uint64
+		var cur *mp4Chunk
+		for i, s := range t.samples {
+			if cur == nil || chunkDur >= limit {
+				cur = &mp4Chunk{track: ti, first: i, start: float64(dts) / float64(t.ref.Timescale)}
+				chunks = append(chunks, cur)
+				t.chunks = append(t.chunks, i)
+				chunkDur = 0
+			}
+			cur.count++
+			cur.size += uint64(s.Size)
+			chunkDur += uint64(s.Delta)
+			dts += uint64(s.Delta)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].start < chunks[j].start })
+	return chunks
+}
+
+// assignOffsets places the chunks after base in output order and records
+// each track's chunk offsets.
+func assignOffsets(chunks []*mp4Chunk, tracks []*outTrack, base uint64) {
+	for _, c := range chunks {
+		tracks[c.track].offsets = append(tracks[c.track].offsets, base)
+		base += c.size
+	}
+}
+
+func writeMP4(w io.Writer, ftyp, moov []byte, mdatHdr, dataSize uint64, chunks []*mp4Chunk, tracks []*outTrack, inputs []Segment) error {
+	if _, err := w.Write(ftyp); err != nil {
+		return err
+	}
+	if _, err := w.Write(moov); err != nil {
+		return err
+	}
+	var hdr []byte
+	if mdatHdr == 16 {
+		hdr = binary.BigEndian.AppendUint32(hdr, 1)
+		hdr = append(hdr, "mdat"...)
+		hdr = binary.BigEndian.AppendUint64(hdr, dataSize+16)
+	} else {
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(dataSize+8))
+		hdr = append(hdr, "mdat"...)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	readers := make(map[int32]*os.File)
+	defer func() {
+		for _, f := range readers {
+			_ = f.Close()
+		}
+	}()
+	for _, c := range chunks {
+		samples := tracks[c.track].samples[c.first : c.first+c.count]
+		// Copy runs of samples that are contiguous in the same input.
+		for i := 0; i < len(samples); {
+			s := samples[i]
+			n := int64(s.Size)
+			j := i + 1
+			for ; j < len(samples) && samples[j].File == s.File && samples[j].Offset == s.Offset+n; j++ {
+				n += int64(samples[j].Size)
+			}
+			f, ok := readers[s.File]
+			if !ok {
+				var err error
+				if f, err = os.Open(inputs[s.File].Path); err != nil {
+					return err
+				}
+				readers[s.File] = f
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(f, s.Offset, n)); err != nil {
+				return fmt.Errorf("copy from %s: %w", inputs[s.File].Path, err)
+			}
+			i = j
+		}
+	}
+	return nil
+}
+
+func mp4BoxBytes(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return mp4BoxBytes(typ, append([][]byte{hdr}, payload...)...)
+}
+
+func mp4Ftyp() []byte {
+	var b []byte
+	b = append(b, "isom"...)
+	b = binary.BigEndian.AppendUint32(b, 0x200)
+	for _, brand := range []string{"isom", "iso2", "avc1", "mp41"} {
+		b = append(b, brand...)
+	}
+	return mp4BoxBytes("ftyp", b)
+}
+
+// mp4Matrix is the identity transformation matrix of mvhd/tkhd.
+var mp4Matrix = []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000}
+
+func buildMoov(tracks []*outTrack, created time.Time, metadata [][2]string, co64 bool) []byte {
+	ts := uint64(created.Sub(mp4Epoch) / time.Second)
+	var movieDur uint64
+	for _, t := range tracks {
+		d := t.dur * mp4MovieTimescale / uint64(t.ref.Timescale)
+		if d > movieDur {
+			movieDur = d
+		}
+	}
+
+	var mvhd []byte
+	mvhd = binary.BigEndian.AppendUint64(mvhd, ts)
+	mvhd = binary.BigEndian.AppendUint64(mvhd, ts)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, mp4MovieTimescale)
+	mvhd = binary.BigEndian.AppendUint64(mvhd, movieDur)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, 0x10000) // rate 1.0
+	mvhd = binary.BigEndian.AppendUint16(mvhd, 0x100)   // volume 1.0
+	mvhd = append(mvhd, make([]byte, 10)...)
+	for _, m := range mp4Matrix {
+		mvhd = binary.BigEndian.AppendUint32(mvhd, m)
+	}
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = binary.BigEndian.AppendUint32(mvhd, uint32(len(tracks)+1))
+
+	parts := [][]byte{mp4FullBox("mvhd", 1, 0, mvhd)}
+	for i, t := range tracks {
+		parts = append(parts, buildTrak(t, uint32(i+1), ts, co64))
+	}
+	if udta := buildUdta(metadata); udta != nil {
+		parts = append(parts, udta)
+	}
+	return mp4BoxBytes("moov", parts...)
+}
+
+func buildTrak(t *outTrack, id uint32, ts uint64, co64 bool) []byte {
+	dur := t.dur
+	var tkhd []byte
+	tkhd = binary.BigEndian.AppendUint64(tkhd, ts)
+	tkhd = binary.BigEndian.AppendUint64(tkhd, ts)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, id)
+	tkhd = append(tkhd, make([]byte, 4)...)
+	tkhd = binary.BigEndian.AppendUint64(tkhd, dur*mp4MovieTimescale/uint64(t.ref.Timescale))
+	tkhd = append(tkhd, make([]byte, 8+2+2)...)
+	tkhd = binary.BigEndian.AppendUint16(tkhd, t.ref.Volume)
+	tkhd = append(tkhd, make([]byte, 2)...)
+	for _, m := range mp4Matrix {
+		tkhd = binary.BigEndian.AppendUint32(tkhd, m)
+	}
+	tkhd = binary.BigEndian.AppendUint32(tkhd, t.ref.Width)
+	tkhd = binary.BigEndian.AppendUint32(tkhd, t.ref.Height)
+
+	var mdhd []byte
+	mdhd = binary.BigEndian.AppendUint64(mdhd, ts)
+	mdhd = binary.BigEndian.AppendUint64(mdhd, ts)
+	mdhd = binary.BigEndian.AppendUint32(mdhd, t.ref.Timescale)
+	mdhd = binary.BigEndian.AppendUint64(mdhd, dur)
+	mdhd = binary.BigEndian.AppendUint16(mdhd, t.ref.Language)
+	mdhd = append(mdhd, 0, 0)
+
+	dinf := t.ref.Dinf
+	if dinf == nil {
+		dinf = mp4BoxBytes("dinf", mp4FullBox("dref", 0, 0, binary.BigEndian.AppendUint32(nil, 1), mp4FullBox("url ", 0, 1)))
+	}
+	minf := [][]byte{}
+	if t.ref.MediaHdr != nil {
+		minf = append(minf, t.ref.MediaHdr)
+	}
+	minf = append(minf, dinf, buildStbl(t, co64))
+
+	parts := [][]byte{mp4FullBox("tkhd", 1, 3, tkhd)} // enabled, in movie
+	if off := t.ref.EditOffset; off > 0 {
+		// Presentation starts off ticks into the media, as in the inputs.
+		var elst []byte
+		elst = binary.BigEndian.AppendUint32(elst, 1)
+		elst = binary.BigEndian.AppendUint64(elst, (dur-min(dur, uint64(off)))*mp4MovieTimescale/uint64(t.ref.Timescale))
+		elst = binary.BigEndian.AppendUint64(elst, uint64(off))
+		elst = binary.BigEndian.AppendUint32(elst, 0x10000)
+		parts = append(parts, mp4BoxBytes("edts", mp4FullBox("elst", 1, 0, elst)))
+	}
+	mdia := mp4BoxBytes("mdia",
+		mp4FullBox("mdhd", 1, 0, mdhd),
+		t.ref.Hdlr,
+		mp4BoxBytes("minf", minf...))
+	return mp4BoxBytes("trak", append(parts, mdia)...)
+}
+
+func buildStbl(t *outTrack, co64 bool) []byte {
+	parts := [][]byte{t.ref.Stsd}
+
+	// stts: run-length decoding deltas.
+	var stts []byte
+	runs := 0
+	for i := 0; i < len(t.samples); {
+		j := i + 1
+		for j < len(t.samples) && t.samples[j].Delta == t.samples[i].Delta {
+			j++
+		}
+		stts = binary.BigEndian.AppendUint32(stts, uint32(j-i))
+		stts = binary.BigEndian.AppendUint32(stts, t.samples[i].Delta)
+		runs++
+		i = j
+	}
+	parts = append(parts, mp4FullBox("stts", 0, 0, binary.BigEndian.AppendUint32(nil, uint32(runs)), stts))
+
+	if t.hasCTS {
+		var ctts []byte
+		runs, version := 0, uint8(0)
+		for i := 0; i < len(t.samples); {
+			j := i + 1
+			for j < len(t.samples) && t.samples[j].CTS == t.samples[i].CTS {
+				j++
+			}
+			if t.samples[i].CTS < 0 {
+				version = 1
+			}
+			ctts = binary.BigEndian.AppendUint32(ctts, uint32(j-i))
+			ctts = binary.BigEndian.AppendUint32(ctts, uint32(t.samples[i].CTS))
+			runs++
+			i = j
+		}
+		parts = append(parts, mp4FullBox("ctts", version, 0, binary.BigEndian.AppendUint32(nil, uint32(runs)), ctts))
+	}
+
+	if t.hasSync {
+		var stss []byte
+		n := 0
+		for i, s := range t.samples {
+			if s.Sync {
+				stss = binary.BigEndian.AppendUint32(stss, uint32(i+1))
+				n++
+			}
+		}
+		parts = append(parts, mp4FullBox("stss", 0, 0, binary.BigEndian.AppendUint32(nil, uint32(n)), stss))
+	}
+
+	// stsc: one entry per change of samples-per-chunk.
+	var stsc []byte
+	entries := 0
+	prev := -1
+	for c := range t.chunks {
+		end := len(t.samples)
+		if c+1 < len(t.chunks) {
+			end = t.chunks[c+1]
+		}
+		if n := end - t.chunks[c]; n != prev {
+			stsc = binary.BigEndian.AppendUint32(stsc, uint32(c+1))
+			stsc = binary.BigEndian.AppendUint32(stsc, uint32(n))
+			stsc = binary.BigEndian.AppendUint32(stsc, 1)
+			entries++
+			prev = n
+		}
+	}
+	parts = append(parts, mp4FullBox("stsc", 0, 0, binary.BigEndian.AppendUint32(nil, uint32(entries)), stsc))
+
+	stsz := binary.BigEndian.AppendUint32(nil, 0)
+	stsz = binary.BigEndian.AppendUint32(stsz, uint32(len(t.samples)))
+	for _, s := range t.samples {
+		stsz = binary.BigEndian.AppendUint32(stsz, s.Size)
+	}
+	parts = append(parts, mp4FullBox("stsz", 0, 0, stsz))
+
+	co := binary.BigEndian.AppendUint32(nil, uint32(len(t.offsets)))
+	for _, off := range t.offsets {
+		if co64 {
+			co = binary.BigEndian.AppendUint64(co, off)
+		} else {
+			co = binary.BigEndian.AppendUint32(co, uint32(off))
+		}
+	}
+	if len(t.offsets) == 0 {
+		// First pass: reserve room for the offsets.
+		co = binary.BigEndian.AppendUint32(nil, uint32(len(t.chunks)))
+		width := 4
+		if co64 {
+			width = 8
+		}
+		co = append(co, make([]byte, width*len(t.chunks))...)
+	}
+	if co64 {
+		parts = append(parts, mp4FullBox("co64", 0, 0, co))
+	} else {
+		parts = append(parts, mp4FullBox("stco", 0, 0, co))
+	}
+	return mp4BoxBytes("stbl", parts...)
+}
+
+// buildUdta stores custom tags the way ffmpeg's use_metadata_tags does: a
+// meta box with an mdta handler, a keys box and an ilst of UTF-8 values.
+// creation_time is carried by mvhd instead.
+func buildUdta(metadata [][2]string) []byte {
+	var keys, items []byte
+	n := 0
+	for _, kv := range metadata {
+		if kv[0] == "creation_time" {
+			continue
+		}
+		n++
+		keys = append(keys, mp4BoxBytes("mdta", []byte(kv[0]))...)
+		data := binary.BigEndian.AppendUint32(nil, 1) // UTF-8
+		data = binary.BigEndian.AppendUint32(data, 0)
+		data = append(data, kv[1]...)
+		var idx [4]byte
+		binary.BigEndian.PutUint32(idx[:], uint32(n))
+		items = append(items, mp4BoxBytes(string(idx[:]), mp4BoxBytes("data", data))...)
+	}
+	if n == 0 {
+		return nil
+	}
+	hdlr := make([]byte, 4)
+	hdlr = append(hdlr, "mdta"...)
+	hdlr = append(hdlr, make([]byte, 13)...)
+	return mp4BoxBytes("udta", mp4FullBox("meta", 0, 0,
+		mp4FullBox("hdlr", 0, 0, hdlr),
+		mp4FullBox("keys", 0, 0, binary.BigEndian.AppendUint32(nil, uint32(n)), keys),
+		mp4BoxBytes("ilst", items)))
+}
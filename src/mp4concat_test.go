@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNativeUnsupported(t *testing.T) {
+	mp4 := []Segment{{Path: "/cam/in/a.mp4"}, {Path: "/cam/in/b.mp4"}}
+	tests := []struct {
+		name   string
+		job    concatJob
+		inputs []Segment
+		want   string
+	}{
+		{name: "zero profile stream-copies", inputs: mp4},
+		{name: "explicit copy", job: concatJob{Transcode: transcodeProfile{Codec: transcodeCopy, Audio: audioCopy}}, inputs: mp4},
+		{name: "audio re-encode", job: concatJob{Transcode: transcodeProfile{Audio: audioMono}}, inputs: mp4, want: "re-encode"},
+		{name: "video re-encode", job: concatJob{Transcode: transcodeProfile{Codec: "h265"}}, inputs: mp4, want: "re-encode"},
+		{name: "chapters", job: concatJob{MetaFile: "/tmp/chapters.txt"}, inputs: mp4, want: "write chapters"},
+		{name: "other container", inputs: []Segment{{Path: "/cam/in/a.mkv"}}, want: "read .mkv files"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nativeUnsupported(tt.job, tt.inputs); got != tt.want {
+				t.Errorf("nativeUnsupported = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testTrack describes a track of a synthetic MP4 with samples of distinct
+// sizes and contents.
+type testTrack struct {
+	handler string
+	delta   uint32
+	samples int
+	// sync lists the 1-based sync samples; nil means every sample.
+	sync []uint32
+	// edits are elst entries as (media time, rate) pairs.
+	edits [][2]uint32
+}
+
+const testTimescale = 1000
+
+// testSampleData is the content of sample i of track ti in file fi.
+func testSampleData(fi, ti, i int) []byte {
+	b := make([]byte, 10+i%7)
+	for j := range b {
+		b[j] = byte(fi*64 + ti*32 + i)
+	}
+	return b
+}
+
+// writeTestMP4 writes a progressive MP4 with one chunk per track.
+func writeTestMP4(t *testing.T, path string, fi int, tracks []testTrack) {
+	t.Helper()
+	build := func(offsets []uint32) []byte {
+		mvhd := u32s(0, 0, testTimescale, 0, 0x10000)
+		mvhd = append(mvhd, make([]byte, 2+10+36+24)...)
+		mvhd = append(mvhd, u32s(uint32(len(tracks)+1))...)
+		parts := [][]byte{mp4FullBox("mvhd", 0, 0, mvhd)}
+		for ti, tr := range tracks {
+			dur := tr.delta * uint32(tr.samples)
+			tkhd := u32s(0, 0, uint32(ti+1), 0, dur)
+			tkhd = append(tkhd, make([]byte, 8+2+2+2+2+36)...)
+			tkhd = append(tkhd, u32s(0, 0)...)
+			entry, mhd := mp4BoxBytes("mp4a", make([]byte, 28)), mp4FullBox("smhd", 0, 0, make([]byte, 4))
+			if tr.handler == "vide" {
+				entry, mhd = mp4BoxBytes("avc1", make([]byte, 78)), mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+			}
+			sizes := u32s(0, uint32(tr.samples))
+			for i := 0; i < tr.samples; i++ {
+				sizes = append(sizes, u32s(uint32(len(testSampleData(fi, ti, i))))...)
+			}
+			stbl := [][]byte{
+				mp4FullBox("stsd", 0, 0, u32s(1), entry),
+				mp4FullBox("stts", 0, 0, u32s(1, uint32(tr.samples), tr.delta)),
+			}
+			if tr.sync != nil {
+				stbl = append(stbl, mp4FullBox("stss", 0, 0, u32s(uint32(len(tr.sync))), u32s(tr.sync...)))
+			}
+			stbl = append(stbl,
+				mp4FullBox("stsc", 0, 0, u32s(1, 1, uint32(tr.samples), 1)),
+				mp4FullBox("stsz", 0, 0, sizes),
+				mp4FullBox("stco", 0, 0, u32s(1, offsets[ti])))
+			trak := [][]byte{mp4FullBox("tkhd", 0, 3, tkhd)}
+			if tr.edits != nil {
+				elst := u32s(uint32(len(tr.edits)))
+				for _, e := range tr.edits {
+					elst = append(elst, u32s(dur, e[0], e[1])...)
+				}
+				trak = append(trak, mp4BoxBytes("edts", mp4FullBox("elst", 0, 0, elst)))
+			}
+			trak = append(trak, mp4BoxBytes("mdia",
+				mp4FullBox("mdhd", 0, 0, u32s(0, 0, testTimescale, dur), []byte{0x55, 0xc4, 0, 0}),
+				mp4FullBox("hdlr", 0, 0, u32s(0), []byte(tr.handler), make([]byte, 13)),
+				mp4BoxBytes("minf", mhd,
+					mp4BoxBytes("dinf", mp4FullBox("dref", 0, 0, u32s(1), mp4FullBox("url ", 0, 1))),
+					mp4BoxBytes("stbl", stbl...))))
+			parts = append(parts, mp4BoxBytes("trak", trak...))
+		}
+		return mp4BoxBytes("moov", parts...)
+	}
+
+	var data []byte
+	offsets := make([]uint32, len(tracks))
+	ftyp := mp4Ftyp()
+	base := uint32(len(ftyp) + len(build(offsets)) + 8)
+	for ti, tr := range tracks {
+		offsets[ti] = base + uint32(len(data))
+		for i := 0; i < tr.samples; i++ {
+			data = append(data, testSampleData(fi, ti, i)...)
+		}
+	}
+	file := append(append(ftyp, build(offsets)...), mp4BoxBytes("mdat", data)...)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNativeConcatRoundTrip(t *testing.T) {
+	video := testTrack{handler: "vide", delta: 100, samples: 10, sync: []uint32{1, 6}}
+	audio := testTrack{handler: "soun", delta: 50, samples: 20}
+	withEdit := func(tr testTrack, edits ...[2]uint32) testTrack {
+		tr.edits = edits
+		return tr
+	}
+	tests := []struct {
+		name   string
+		tracks [2][]testTrack
+		// inPoint trims the second file.
+		inPoint time.Duration
+		// first is the first sample kept of each track of the second file.
+		first      []int
+		editOffset int64
+		wantErr    string
+	}{
+		{name: "two files", tracks: [2][]testTrack{{video, audio}, {video, audio}}, first: []int{0, 0}},
+		// 400ms is not a keyframe: all tracks start on the next one at 500ms.
+		{name: "in-point cut on keyframe", tracks: [2][]testTrack{{video, audio}, {video, audio}},
+			inPoint: 400 * time.Millisecond, first: []int{5, 10}},
+		{name: "edit offset carried over",
+			tracks:     [2][]testTrack{{withEdit(video, [2]uint32{100, 0x10000}), audio}, {withEdit(video, [2]uint32{100, 0x10000}), audio}},
+			first:      []int{0, 0},
+			editOffset: 100},
+		{name: "empty edit refused",
+			tracks:  [2][]testTrack{{withEdit(video, [2]uint32{0xffffffff, 0x10000}, [2]uint32{0, 0x10000}), audio}, {video, audio}},
+			wantErr: "edit list"},
+		{name: "differing edit offsets refused",
+			tracks:  [2][]testTrack{{withEdit(video, [2]uint32{100, 0x10000}), audio}, {video, audio}},
+			wantErr: "edit list offset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var inputs []Segment
+			for fi, tracks := range tt.tracks {
+				path := filepath.Join(dir, fmt.Sprintf("in%d.mp4", fi))
+				writeTestMP4(t, path, fi, tracks)
+				inputs = append(inputs, Segment{Path: path})
+			}
+			inputs[1].InPoint = tt.inPoint
+			out := filepath.Join(dir, "out.mp4")
+			err := nativeConcat(inputs, out, [][2]string{{"camera", "test"}}, time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("nativeConcat error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var top []string
+			for off := int64(0); off < int64(len(raw)); {
+				typ, _, size, err := readBoxHeader(bytes.NewReader(raw), off, int64(len(raw)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				top = append(top, typ)
+				off += size
+			}
+			if strings.Join(top, ",") != "ftyp,moov,mdat" {
+				t.Errorf("top-level boxes %v, want faststart ftyp,moov,mdat", top)
+			}
+
+			mf, err := readMP4(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mf.Tracks) != 2 {
+				t.Fatalf("%d tracks, want 2", len(mf.Tracks))
+			}
+			for ti, got := range mf.Tracks {
+				spec := tt.tracks[0][ti]
+				var want [][]byte
+				var wantSync []bool
+				for fi := range tt.tracks {
+					from := 0
+					if fi == 1 {
+						from = tt.first[ti]
+					}
+					for i := from; i < spec.samples; i++ {
+						want = append(want, testSampleData(fi, ti, i))
+						sync := spec.sync == nil || i == 0 || i == 5
+						wantSync = append(wantSync, sync)
+					}
+				}
+				if len(got.Samples) != len(want) {
+					t.Fatalf("track %d has %d samples, want %d", ti+1, len(got.Samples), len(want))
+				}
+				if wantDur := uint64(len(want)) * uint64(spec.delta); got.Duration != wantDur {
+					t.Errorf("track %d lasts %d ticks, want %d", ti+1, got.Duration, wantDur)
+				}
+				for i, s := range got.Samples {
+					data := raw[s.Offset : s.Offset+int64(s.Size)]
+					if !bytes.Equal(data, want[i]) {
+						t.Fatalf("track %d sample %d holds %v, want %v", ti+1, i, data, want[i])
+					}
+					if s.Sync != wantSync[i] {
+						t.Errorf("track %d sample %d sync=%v, want %v", ti+1, i, s.Sync, wantSync[i])
+					}
+				}
+			}
+			if got := mf.Tracks[0].EditOffset; got != tt.editOffset {
+				t.Errorf("video edit offset %d, want %d", got, tt.editOffset)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SegmentName is what a naming scheme extracts from a segment file. Times
+// carry the wall clock written in the name as UTC; callers move them into
+// the source's timezone with wallClockIn.
+type SegmentName struct {
+	Start time.Time
+	// End is zero when the scheme does not encode it; it is inferred later.
+	End time.Time
+	Ext string
+	// Camera, when captured, is appended to the source key so that several
+	// cameras sharing one folder are still merged separately.
+	Camera string
+	// DirDepth is the number of folder levels between the source folder and
+	// the file (e.g. 1 for legacy per-hour folders).
+	DirDepth int
+}
+
+// SegmentScheme recognises one vendor's segment naming.
+type SegmentScheme interface {
+	Name() string
+	// Parse inspects the file name and the names of its parent folders.
+	Parse(dir, name string) (SegmentName, bool)
+}
+
+const defaultSchemes = "xiaomi,xiaomi-legacy"
+
+// Built-in presets for vendors whose file names fit a single pattern.
+var patternPresets = map[string]struct {
+	pattern string
+	layout  string
+}{
+	// RecM01_20240101_120530_121030_6E8A2B_1A2B3C.mp4
+	"reolink": {`^Rec[MS](?P<camera>\d+)_(?P<date>\d{8})_(?P<start>\d{6})_(?P<end>\d{6})`, "20060102150405"},
+	// 20240101_120530_tp00017.mp4; the end is inferred like legacy Xiaomi.
+	"tapo": {`^(?P<date>\d{8})_(?P<start>\d{6})_tp\d+`, "20060102150405"},
+	// ch01_20240101120530_20240101121030.mp4 (SD card, iVMS) or
+	// 192.168.1.64_01_20240101120530_20240101121030_1.mp4 (web UI, NVR).
+	"hikvision": {`^(?:ch|\d+(?:\.\d+){3}_)(?P<camera>\d+)_(?P<start>\d{14})_(?P<end>\d{14})`, tsLayout},
+}
+
+func isDigits14(s string) bool {
+	return len(s) == 14 && isDigits(s)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseTimeSpan parses YYYYMMDDHHMMSS_YYYYMMDDHHMMSS[.ext].
+func parseTimeSpan(s string) (start, end time.Time, ext string, ok bool) {
+	if len(s) < 29 {
+		return time.Time{}, time.Time{}, "", false
+	}
+	startStr := s[:14]
+	if s[14] != '_' {
+		return time.Time{}, time.Time{}, "", false
+	}
+	tail := s[15:]
+	endStr := tail[:14]
+	ext = tail[14:]
+	if ext != "" && ext[0] != '.' {
+		return time.Time{}, time.Time{}, "", false
+	}
+	if !isDigits14(startStr) || !isDigits14(endStr) {
+		return time.Time{}, time.Time{}, "", false
+	}
+	st, err1 := time.ParseInLocation(tsLayout, startStr, time.UTC)
+	et, err2 := time.ParseInLocation(tsLayout, endStr, time.UTC)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, time.Time{}, "", false
+	}
+	return st, et, ext, true
+}
+
+// Xiaomi: 00_YYYYMMDDHHMMSS_YYYYMMDDHHMMSS[.ext]
+type xiaomiScheme struct{}
+
+func (xiaomiScheme) Name() string { return "xiaomi" }
+
+func (xiaomiScheme) Parse(dir, name string) (SegmentName, bool) {
+	if !strings.HasPrefix(name, "00_") {
+		return SegmentName{}, false
+	}
+	st, et, ext, ok := parseTimeSpan(name[3:])
+	if !ok {
+		return SegmentName{}, false
+	}
+	return SegmentName{Start: st, End: et, Ext: ext}, true
+}
+
+// Legacy layout written by older Xiaomi/Mijia cameras:
+// YYYYMMDDHH/MMmSSs_<unix>[.ext]
+// The start time comes from the hour directory plus the minute/second prefix;
+// the end time is not encoded and has to be inferred.
+type xiaomiLegacyScheme struct{}
+
+func (xiaomiLegacyScheme) Name() string { return "xiaomi-legacy" }
+
+func (xiaomiLegacyScheme) Parse(dir, name string) (SegmentName, bool) {
+	hourDir := filepath.Base(dir)
+	if len(hourDir) != 10 || !isDigits(hourDir) {
+		return SegmentName{}, false
+	}
+	if len(name) < 8 {
+		return SegmentName{}, false
+	}
+	if !isDigits(name[0:2]) || (name[2] != 'M' && name[2] != 'm') {
+		return SegmentName{}, false
+	}
+	if !isDigits(name[3:5]) || (name[5] != 'S' && name[5] != 's') || name[6] != '_' {
+		return SegmentName{}, false
+	}
+	rest := name[7:]
+	unixStr := rest
+	ext := ""
+	if i := strings.IndexByte(rest, '.'); i >= 0 {
+		unixStr = rest[:i]
+		ext = rest[i:]
+	}
+	if !isDigits(unixStr) {
+		return SegmentName{}, false
+	}
+	hour, err := time.ParseInLocation("2006010215", hourDir, time.UTC)
+	if err != nil {
+		return SegmentName{}, false
+	}
+	mm := int(name[0]-'0')*10 + int(name[1]-'0')
+	ss := int(name[3]-'0')*10 + int(name[4]-'0')
+	if mm > 59 || ss > 59 {
+		return SegmentName{}, false
+	}
+	start := hour.Add(time.Duration(mm)*time.Minute + time.Duration(ss)*time.Second)
+	return SegmentName{Start: start, Ext: ext, DirDepth: 1}, true
+}
+
+// Merged outputs written by this tool: YYYYMMDDHHMMSS_YYYYMMDDHHMMSS[.ext]
+type mergedScheme struct{}
+
+func (mergedScheme) Name() string { return "merged" }
+
+func (mergedScheme) Parse(dir, name string) (SegmentName, bool) {
+	st, et, ext, ok := parseTimeSpan(name)
+	if !ok {
+		return SegmentName{}, false
+	}
+	return SegmentName{Start: st, End: et, Ext: ext}, true
+}
+
+// patternScheme matches file names against a regular expression with named
+// captures: start (required), end, date, camera and ext. When date is
+// captured it is prepended to start/end before parsing with layout, and an
+// end earlier than start is taken to be on the following day.
+type patternScheme struct {
+	name   string
+	re     *regexp.Regexp
+	layout string
+}
+
+func newPatternScheme(name, pattern, layout string) (*patternScheme, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	if re.SubexpIndex("start") < 0 {
+		return nil, fmt.Errorf("pattern must have a named capture 'start'")
+	}
+	if strings.TrimSpace(layout) == "" {
+		layout = tsLayout
+	}
+	return &patternScheme{name: name, re: re, layout: layout}, nil
+}
+
+func (p *patternScheme) Name() string { return p.name }
+
+func (p *patternScheme) Parse(dir, name string) (SegmentName, bool) {
+	m := p.re.FindStringSubmatch(name)
+	if m == nil {
+		return SegmentName{}, false
+	}
+	group := func(key string) string {
+		if i := p.re.SubexpIndex(key); i >= 0 {
+			return m[i]
+		}
+		return ""
+	}
+	date := group("date")
+	st, err := time.ParseInLocation(p.layout, date+group("start"), time.UTC)
+	if err != nil {
+		return SegmentName{}, false
+	}
+	out := SegmentName{Start: st, Camera: group("camera"), Ext: group("ext")}
+	if endStr := group("end"); endStr != "" {
+		et, err := time.ParseInLocation(p.layout, date+endStr, time.UTC)
+		if err != nil {
+			return SegmentName{}, false
+		}
+		if date != "" && et.Before(st) {
+			et = et.AddDate(0, 0, 1)
+		}
+		out.End = et
+	}
+	if out.Ext == "" {
+		out.Ext = filepath.Ext(name)
+	} else if out.Ext[0] != '.' {
+		out.Ext = "." + out.Ext
+	}
+	return out, true
+}
+
+// buildSchemes resolves a comma-separated list of scheme names and appends a
+// user-defined pattern scheme when pattern is set.
+func buildSchemes(names, pattern, layout string) ([]SegmentScheme, error) {
+	var schemes []SegmentScheme
+	for _, n := range strings.Split(names, ",") {
+		n = strings.ToLower(strings.TrimSpace(n))
+		switch n {
+		case "":
+			continue
+		case "xiaomi":
+			schemes = append(schemes, xiaomiScheme{})
+		case "xiaomi-legacy":
+			schemes = append(schemes, xiaomiLegacyScheme{})
+		default:
+			preset, ok := patternPresets[n]
+			if !ok {
+				return nil, fmt.Errorf("unknown scheme '%s'", n)
+			}
+			s, err := newPatternScheme(n, preset.pattern, preset.layout)
+			if err != nil {
+				return nil, err
+			}
+			schemes = append(schemes, s)
+		}
+	}
+	if strings.TrimSpace(pattern) != "" {
+		s, err := newPatternScheme("custom", pattern, layout)
+		if err != nil {
+			return nil, err
+		}
+		schemes = append(schemes, s)
+	}
+	if len(schemes) == 0 {
+		return nil, fmt.Errorf("no segment naming scheme configured")
+	}
+	return schemes, nil
+}
+
+func parseSegmentName(schemes []SegmentScheme, dir, name string) (SegmentName, string, bool) {
+	for _, s := range schemes {
+		if n, ok := s.Parse(dir, name); ok {
+			return n, s.Name(), true
+		}
+	}
+	return SegmentName{}, "", false
+}
+
+func schemeNames(schemes []SegmentScheme) string {
+	names := make([]string, 0, len(schemes))
+	for _, s := range schemes {
+		names = append(names, s.Name())
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPatternPresets(t *testing.T) {
+	tests := []struct {
+		scheme, name string
+		camera       string
+		start, end   string
+	}{
+		{scheme: "reolink", name: "RecM01_20240101_235530_000530_6E8A2B_1A2B3C.mp4", camera: "01", start: "20240101235530", end: "20240102000530"},
+		{scheme: "tapo", name: "20240101_120530_tp00017.mp4", start: "20240101120530"},
+		{scheme: "hikvision", name: "ch01_20240101120530_20240101121030.mp4", camera: "01", start: "20240101120530", end: "20240101121030"},
+		{scheme: "hikvision", name: "192.168.1.64_02_20240101120530_20240101121030_1.mp4", camera: "02", start: "20240101120530", end: "20240101121030"},
+		// Xiaomi and merged names are left to their own schemes.
+		{scheme: "hikvision", name: "00_20240101120530_20240101121030.mp4"},
+		{scheme: "hikvision", name: "20240101120530_20240101121030.mp4"},
+		{scheme: "tapo", name: "20240101_120530.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme+"/"+tt.name, func(t *testing.T) {
+			schemes, err := buildSchemes(tt.scheme, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, ok := schemes[0].Parse("/cam/in", tt.name)
+			if ok != (tt.start != "") {
+				t.Fatalf("matched=%v, want %v", ok, tt.start != "")
+			}
+			if !ok {
+				return
+			}
+			format := func(ts time.Time) string {
+				if ts.IsZero() {
+					return ""
+				}
+				return ts.Format(tsLayout)
+			}
+			if n.Camera != tt.camera || format(n.Start) != tt.start || format(n.End) != tt.end || n.Ext != ".mp4" {
+				t.Errorf("parsed camera=%q start=%s end=%s ext=%s, want camera=%q start=%s end=%s ext=.mp4",
+					n.Camera, format(n.Start), format(n.End), n.Ext, tt.camera, tt.start, tt.end)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Merges are written to a hidden partial file next to the final output and
+// renamed into place only after they have been verified and synced, so an
+// interrupted run never leaves a truncated file under a valid output name.
+const partialMarker = ".partial"
+
+func partialPath(outPath string) string {
+	dir, name := filepath.Split(outPath)
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, "."+strings.TrimSuffix(name, ext)+partialMarker+ext)
+}
+
+func isPartialName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, partialMarker+".")
+}
+
+// verifyOutput checks that the merger can probe the file and that it reports
+// a duration.
+func verifyOutput(fsys FileSystem, m Merger, path string) error {
+	st, err := fsys.Stat(path)
+	if err != nil {
+		return err
+	}
+	if st.Size() == 0 {
+		return fmt.Errorf("output is empty")
+	}
+	info, err := m.Probe(path)
+	if err != nil {
+		return fmt.Errorf("output is unreadable: %w", err)
+	}
+	if info.Duration <= 0 {
+		return fmt.Errorf("output has no duration")
+	}
+	return nil
+}
+
+// commitOutput verifies, syncs and renames a partial file into place. The
+// partial file is removed on failure.
+func commitOutput(fsys FileSystem, m Merger, tmpPath, outPath string, lg *logBuffer) error {
+	if err := verifyOutput(fsys, m, tmpPath); err != nil {
+		_ = fsys.Remove(tmpPath)
+		return fmt.Errorf("Verify merged output failed: %w", err)
+	}
+	if err := fsys.Sync(tmpPath); err != nil {
+		_ = fsys.Remove(tmpPath)
+		return fmt.Errorf("Sync merged output failed: %w", err)
+	}
+	if err := fsys.Rename(tmpPath, outPath); err != nil {
+		_ = fsys.Remove(tmpPath)
+		return fmt.Errorf("Rename merged output failed: %w", err)
+	}
+	if err := fsys.Sync(filepath.Dir(outPath)); err != nil {
+		lg.Warn("Sync output directory %s failed: %v", filepath.Dir(outPath), err)
+	}
+	return nil
+}
+
+// sweepPartialOutputs removes partial files left behind by interrupted runs.
+func sweepPartialOutputs(fsys FileSystem, outDir string) {
+	if _, err := fsys.Stat(outDir); err != nil {
+		return
+	}
+	removed := 0
+	err := walkDir(fsys, outDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !isPartialName(d.Name()) {
+			return nil
+		}
+		if d.IsDir() {
+			// Scratch directory of an interrupted re-encode.
+			if err := fsys.RemoveAll(path); err != nil {
+				logWarn("Failed to remove leftover partial output %s: %v", path, err)
+			} else {
+				removed++
+			}
+			return filepath.SkipDir
+		}
+		if err := fsys.Remove(path); err != nil {
+			logWarn("Failed to remove leftover partial output %s: %v", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		logWarn("Sweep partial outputs in %s failed: %v", outDir, err)
+	}
+	if removed > 0 {
+		logInfo("Removed %d leftover partial output(s) in %s", removed, outDir)
+	}
+}
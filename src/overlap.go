@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	overlapKeep = "keep"
+	overlapDrop = "drop"
+	overlapTrim = "trim"
+
+	// Overlaps up to this long come from whole-second file names and are
+	// not reported.
+	overlapTolerance = time.Second
+)
+
+func validOverlapPolicy(v string) bool {
+	switch v {
+	case overlapKeep, overlapDrop, overlapTrim:
+		return true
+	}
+	return false
+}
+
+// overlapIssue describes one segment that duplicates or overlaps footage
+// already covered by Other.
+type overlapIssue struct {
+	Kind    string
+	Path    string
+	Other   string
+	Overlap time.Duration
+}
+
+// resolveOverlaps finds duplicate and overlapping segments of one day and
+// applies the policy: keep reports only, drop removes duplicates and segments
+// wholly covered by earlier ones, trim additionally moves the in-point of
+// partially overlapping segments past the covered part. Segments must be
+// sorted by start time. Content hashes are only computed when duplicates are
+// dropped, so keep never reads the footage.
+func resolveOverlaps(fsys FileSystem, policy string, segs []Segment) ([]Segment, []overlapIssue) {
+	var issues []overlapIssue
+	dup := duplicateSegments(fsys, segs, policy != overlapKeep)
+	out := make([]Segment, 0, len(segs))
+	var covered time.Time
+	var coveredBy string
+	for i, s := range segs {
+		if other, ok := dup[i]; ok {
+			issues = append(issues, overlapIssue{Kind: "duplicate", Path: s.Path, Other: segs[other].Path, Overlap: s.EndTime.Sub(s.StartTime)})
+			if policy != overlapKeep {
+				continue
+			}
+			out = append(out, s)
+			continue
+		}
+		if len(out) > 0 && !s.EndTime.After(covered) {
+			issues = append(issues, overlapIssue{Kind: "contained", Path: s.Path, Other: coveredBy, Overlap: s.EndTime.Sub(s.StartTime)})
+			if policy != overlapKeep {
+				continue
+			}
+		} else if overlap := covered.Sub(s.StartTime); len(out) > 0 && overlap > overlapTolerance {
+			issues = append(issues, overlapIssue{Kind: "overlap", Path: s.Path, Other: coveredBy, Overlap: overlap})
+			if policy == overlapTrim {
+				s.InPoint += overlap
+				s.StartTime = covered
+			}
+		}
+		if s.EndTime.After(covered) {
+			covered = s.EndTime
+			coveredBy = s.Path
+		}
+		out = append(out, s)
+	}
+	return out, issues
+}
+
+// duplicateSegments maps the index of every duplicate segment to the index of
+// the segment it duplicates. Segments with identical times are duplicates of
+// the largest one; with hash set, segments of equal size are also compared by
+// content hash.
+func duplicateSegments(fsys FileSystem, segs []Segment, hash bool) map[int]int {
+	dup := make(map[int]int)
+	byTimes := make(map[[2]int64][]int)
+	for i, s := range segs {
+		key := [2]int64{s.StartTime.UnixNano(), s.EndTime.UnixNano()}
+		byTimes[key] = append(byTimes[key], i)
+	}
+	for _, idx := range byTimes {
+		keep := idx[0]
+		for _, i := range idx[1:] {
+			if segs[i].Size > segs[keep].Size {
+				keep = i
+			}
+		}
+		for _, i := range idx {
+			if i != keep {
+				dup[i] = keep
+			}
+		}
+	}
+
+	if !hash {
+		return dup
+	}
+	bySize := make(map[int64][]int)
+	for i, s := range segs {
+		if _, ok := dup[i]; !ok && s.Size > 0 {
+			bySize[s.Size] = append(bySize[s.Size], i)
+		}
+	}
+	for _, idx := range bySize {
+		if len(idx) < 2 {
+			continue
+		}
+		sort.Ints(idx)
+		first := make(map[string]int)
+		for _, i := range idx {
+			sum, err := fileSHA256(fsys, segs[i].Path)
+			if err != nil {
+				logWarn("Hash %s failed: %v", segs[i].Path, err)
+				continue
+			}
+			if orig, ok := first[sum]; ok {
+				dup[i] = orig
+				continue
+			}
+			first[sum] = i
+		}
+	}
+	return dup
+}
+
+func fileSHA256(fsys FileSystem, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// logOverlapReport writes the per-day summary and one line per issue.
+func logOverlapReport(lg *logBuffer, g *DayGroup, policy string, issues []overlapIssue) {
+	if len(issues) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	var total time.Duration
+	for _, is := range issues {
+		counts[is.Kind]++
+		total += is.Overlap
+	}
+	lg.Warn("Overlap report for source=%s day=%s: %d duplicate(s), %d contained, %d partial overlap(s), %s overlapping footage, policy=%s",
+		g.SourceKey, g.Day, counts["duplicate"], counts["contained"], counts["overlap"], total.Truncate(time.Second), policy)
+	for _, is := range issues {
+		lg.Info("  %s %s (%.1fs) of %s", is.Kind, is.Path, is.Overlap.Seconds(), is.Other)
+	}
+}
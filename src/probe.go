@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ffprobeFormat struct {
+	Duration string `json:"duration"`
+}
+
+type ffprobeStream struct {
+	CodecType  string `json:"codec_type"`
+	CodecName  string `json:"codec_name"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	FrameRate  string `json:"r_frame_rate"`
+	PixFmt     string `json:"pix_fmt"`
+	SampleRate string `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+}
+
+type ffprobeOutput struct {
+	Format  ffprobeFormat   `json:"format"`
+	Streams []ffprobeStream `json:"streams"`
+}
+
+type mediaInfo struct {
+	Duration time.Duration
+	HasVideo bool
+	Format   streamFormat
+}
+
+func ensureFFprobe() error {
+	_, err := exec.LookPath("ffprobe")
+	return err
+}
+
+var (
+	ffprobeOnce  sync.Once
+	ffprobeFound bool
+)
+
+// haveFFprobe reports whether ffprobe is installed; without it MP4 files are
+// probed by the native box reader.
+func haveFFprobe() bool {
+	ffprobeOnce.Do(func() { ffprobeFound = ensureFFprobe() == nil })
+	return ffprobeFound
+}
+
+func runFFprobe(path string) (ffprobeOutput, error) {
+	var out ffprobeOutput
+	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return out, fmt.Errorf("%w: %s", err, msg)
+		}
+		return out, err
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return out, fmt.Errorf("parse ffprobe output: %w", err)
+	}
+	return out, nil
+}
+
+func probeMedia(path string) (mediaInfo, error) {
+	if !haveFFprobe() {
+		return probeMP4(path)
+	}
+	var info mediaInfo
+	out, err := runFFprobe(path)
+	if err != nil {
+		return info, err
+	}
+	d := strings.TrimSpace(out.Format.Duration)
+	if d == "" || d == "N/A" {
+		return info, fmt.Errorf("no duration reported")
+	}
+	secs, err := strconv.ParseFloat(d, 64)
+	if err != nil || secs < 0 {
+		return info, fmt.Errorf("invalid duration '%s'", d)
+	}
+	info.Duration = time.Duration(secs * float64(time.Second))
+	for _, st := range out.Streams {
+		switch {
+		case st.CodecType == "video" && !info.HasVideo:
+			info.HasVideo = true
+			info.Format.VideoCodec = st.CodecName
+			info.Format.Width = st.Width
+			info.Format.Height = st.Height
+			info.Format.FrameRate = st.FrameRate
+			info.Format.PixFmt = st.PixFmt
+		case st.CodecType == "audio" && info.Format.AudioCodec == "":
+			info.Format.AudioCodec = st.CodecName
+			info.Format.SampleRate = st.SampleRate
+			info.Format.Channels = st.Channels
+		}
+	}
+	return info, nil
+}
+
+// probeKeyframes lists the timestamps of the first video stream's keyframe
+// packets. Only the container is read; nothing is decoded.
+func probeKeyframes(path string) ([]time.Duration, error) {
+	if !haveFFprobe() {
+		return mp4Keyframes(path)
+	}
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", path)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	var keys []time.Duration
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "K") {
+			continue
+		}
+		secs, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, time.Duration(secs*float64(time.Second)))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no video keyframes found")
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const quarantineReasonExt = ".reason.txt"
+
+// segmentLocks serialises the probe and quarantine of one file: the halves
+// of a file split at midnight belong to different day groups, which
+// concurrent workers check at the same time.
+var segmentLocks = newKeyedMutex()
+
+// keyedMutex is a set of mutexes keyed by string, kept only while in use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// lock acquires the mutex of key and returns its unlock function.
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// probeSegment returns the stream format of a segment, or why it cannot be
+// merged when ffprobe does not read it as a video with a positive duration.
+func probeSegment(m Merger, s Segment) (streamFormat, error) {
+	info, err := m.Probe(s.Path)
+	if err != nil {
+		return streamFormat{}, err
+	}
+	if info.Duration <= 0 {
+		return streamFormat{}, errors.New("zero duration")
+	}
+	if !info.HasVideo {
+		return streamFormat{}, errors.New("no video stream")
+	}
+	return info.Format, nil
+}
+
+// checkSegments probes every segment of a group and moves unreadable ones to
+// the quarantine directory. It returns the segments that can be merged, with
+// their stream format filled in.
+func checkSegments(cfg Config, segs []Segment, lg *logBuffer) []Segment {
+	m := cfg.merger()
+	ok := make([]Segment, 0, len(segs))
+	for _, s := range segs {
+		if checked, readable := checkSegment(cfg, m, s, lg); readable {
+			ok = append(ok, checked)
+		}
+	}
+	return ok
+}
+
+// checkSegment probes one segment under its path lock and quarantines it
+// when unreadable.
+func checkSegment(cfg Config, m Merger, s Segment, lg *logBuffer) (Segment, bool) {
+	unlock := segmentLocks.lock(s.Path)
+	defer unlock()
+	if _, err := cfg.fs().Stat(s.Path); os.IsNotExist(err) {
+		// Already quarantined as the other half of a midnight split.
+		lg.Warn("Segment %s disappeared before merge, skipping", s.Path)
+		return s, false
+	}
+	format, err := probeSegment(m, s)
+	if err == nil {
+		s.Format = format
+		return s, true
+	}
+	dest, qerr := quarantineSegment(cfg, s.Path, err)
+	if qerr != nil {
+		lg.Error("Unreadable segment %s (%v); quarantine failed: %v", s.Path, err, qerr)
+		return s, false
+	}
+	lg.Warn("Unreadable segment %s quarantined to %s: %v", s.Path, dest, err)
+	return s, false
+}
+
+// quarantineSegment moves path below the quarantine directory, keeping its
+// path relative to the input directory, and writes a reason file next to it.
+func quarantineSegment(cfg Config, path string, reason error) (string, error) {
+	rel, err := filepath.Rel(absClean(cfg.Dir), absClean(path))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+	dest := filepath.Join(cfg.QuarantineDir, rel)
+	fsys := cfg.fs()
+	if err := fsys.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", fmt.Errorf("Create quarantine directory failed: %w", err)
+	}
+	if err := moveFile(fsys, path, dest); err != nil {
+		return "", err
+	}
+	note := fmt.Sprintf("source: %s\nquarantined: %s\nreason: %v\n", path, cfg.clock().Now().Format(time.RFC3339), reason)
+	if err := fsys.WriteFile(dest+quarantineReasonExt, []byte(note), 0o644); err != nil {
+		return dest, fmt.Errorf("Write quarantine reason failed: %w", err)
+	}
+	return dest, nil
+}
+
+// moveFile renames src to dst, copying across host file systems when needed.
+func moveFile(fsys FileSystem, src, dst string) error {
+	err := fsys.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsys.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = fsys.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = fsys.Remove(dst)
+		return err
+	}
+	return fsys.Remove(src)
+}
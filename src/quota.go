@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota retention deletes the oldest footage first until raw segments and
+// merged outputs fit their byte limits and the output volume has enough
+// free space. Raw segments go first, as their merged outputs duplicate
+// them, and follow the same rules as --days: never today, never a day that
+// is not verified as merged. A merged output is only deleted once no raw
+// segment of its day is left, so a full rebuild never merges it again.
+
+// quotaRun carries what quota checks within one run share: the segment scan,
+// verification results and the groups still being merged.
+type quotaRun struct {
+	cfg   Config
+	state *runState
+	// segs is the scan, taken on first use unless useScan supplied it.
+	segs    []Segment
+	scanned bool
+	// verified caches verifyDayMerged per source/day until the group
+	// finishes merging; busy groups are queued or being merged.
+	verified map[string]bool
+	busy     map[string]bool
+}
+
+// quotaFile is a deletion candidate.
+type quotaFile struct {
+	path  string
+	start time.Time
+	size  int64
+	// pieces are the raw segments backed by the file (two when split at
+	// midnight); group is the source/day of a merged output.
+	pieces []Segment
+	group  string
+}
+
+// newQuotaRun returns nil when no quota is configured; enforce on nil does
+// nothing.
+func newQuotaRun(cfg Config, state *runState) *quotaRun {
+	if cfg.MaxRawBytes == 0 && cfg.MaxMergedBytes == 0 && cfg.MinFreePercent == 0 {
+		return nil
+	}
+	return &quotaRun{cfg: cfg, state: state, verified: make(map[string]bool), busy: make(map[string]bool)}
+}
+
+// useScan reuses segments already collected (and split at midnight when
+// configured) instead of scanning the input folder again.
+func (q *quotaRun) useScan(segs []Segment) {
+	if q == nil {
+		return
+	}
+	q.segs = segs
+	q.scanned = true
+}
+
+// markBusy keeps the groups about to be merged out of quota deletion.
+func (q *quotaRun) markBusy(groups []*DayGroup) {
+	if q == nil {
+		return
+	}
+	for _, g := range groups {
+		q.busy[dayGroupKey(g.SourceKey, g.Day)] = true
+	}
+}
+
+// finished releases a merged (or failed) group and drops its cached
+// verification, which its merge may have changed.
+func (q *quotaRun) finished(g *DayGroup) {
+	if q == nil {
+		return
+	}
+	key := dayGroupKey(g.SourceKey, g.Day)
+	delete(q.busy, key)
+	delete(q.verified, key)
+}
+
+// parseByteSize parses a byte count with an optional binary unit, e.g.
+// 500G, 3.5TiB or 1073741824.
+func parseByteSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := 1.0
+	if v != "" {
+		if i := strings.IndexByte("KMGTP", v[len(v)-1]); i >= 0 {
+			for ; i >= 0; i-- {
+				mult *= 1024
+			}
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * mult), nil
+}
+
+// dayMerged reports whether the raw segments of g may be deleted, by the same
+// rules as --days: its merged output expired after a recorded merge, or it
+// is verified.
+func (q *quotaRun) dayMerged(g *DayGroup, now time.Time) bool {
+	key := dayGroupKey(g.SourceKey, g.Day)
+	if q.busy[key] {
+		return false
+	}
+	if ok, cached := q.verified[key]; cached {
+		return ok
+	}
+	ok := mergedExpired(q.cfg, q.state, g, now) || verifyDayMerged(q.cfg, g) == nil
+	q.verified[key] = ok
+	return ok
+}
+
+// enforce deletes raw segments and merged outputs, oldest first, until every
+// limit is met or nothing more may be deleted.
+func (q *quotaRun) enforce() error {
+	if q == nil {
+		return nil
+	}
+	cfg := q.cfg
+	fsys := cfg.fs()
+	now := cfg.clock().Now()
+
+	if !q.scanned {
+		segs, err := collectSegments(cfg)
+		if err != nil {
+			return err
+		}
+		if cfg.SplitMidnight {
+			segs = splitAtMidnight(cfg.merger(), segs)
+		}
+		q.useScan(segs)
+	}
+	groups := groupBySourceAndDay(q.segs)
+	byPath := make(map[string]*quotaFile)
+	gone := make(map[string]bool)
+	var raw []*quotaFile
+	var rawTotal int64
+	remaining := make(map[string]int)
+	for _, s := range q.segs {
+		if gone[s.Path] {
+			continue
+		}
+		f, ok := byPath[s.Path]
+		if !ok {
+			// Deleted by an earlier check or quarantined since the scan.
+			if _, err := fsys.Stat(s.Path); err != nil {
+				gone[s.Path] = true
+				continue
+			}
+			f = &quotaFile{path: s.Path, start: s.StartTime, size: s.Size}
+			byPath[s.Path] = f
+			raw = append(raw, f)
+			rawTotal += s.Size
+		}
+		f.pieces = append(f.pieces, s)
+		remaining[dayGroupKey(s.SourceKey, s.StartTime.Format("20060102"))]++
+	}
+	sortQuotaFiles(raw)
+
+	merged, mergedTotal, err := q.mergedOutputs(now)
+	if err != nil {
+		return err
+	}
+
+	// Free space is measured on the output volume; raw deletions only count
+	// towards it when the input folder shares that volume.
+	var free, total uint64
+	var freed int64
+	volume := cfg.OutDir
+	if _, err := fsys.Stat(volume); err != nil {
+		volume = cfg.Dir
+	}
+	rawOnVolume := volume == cfg.Dir || sameVolume(cfg.Dir, cfg.OutDir)
+	if cfg.MinFreePercent > 0 {
+		free, total, err = diskSpace(volume)
+		if err != nil {
+			logWarn("Quota: cannot read free space of %s, --min-free-percent ignored: %v", volume, err)
+		}
+	}
+	lowFree := func() bool {
+		return total > 0 && float64(free+uint64(freed))*100 < cfg.MinFreePercent*float64(total)
+	}
+
+	var rawDeleted, mergedDeleted int
+	var rawBytes, mergedBytes int64
+	nestedDirs := make(map[string]bool)
+	for _, f := range raw {
+		overRaw := cfg.MaxRawBytes > 0 && rawTotal > cfg.MaxRawBytes
+		if !overRaw && !(rawOnVolume && lowFree()) {
+			break
+		}
+		if !q.rawDeletable(f, groups, now) {
+			continue
+		}
+		if err := fsys.Remove(f.path); err != nil {
+			logWarn("Failed to delete %s: %v", f.path, err)
+			continue
+		}
+		rawTotal -= f.size
+		if rawOnVolume {
+			freed += f.size
+		}
+		rawDeleted++
+		rawBytes += f.size
+		for _, s := range f.pieces {
+			remaining[dayGroupKey(s.SourceKey, s.StartTime.Format("20060102"))]--
+			if s.DirDepth > 0 {
+				nestedDirs[filepath.Dir(s.Path)] = true
+			}
+		}
+	}
+	removeEmptyDirs(fsys, nestedDirs)
+
+	for _, f := range merged {
+		overMerged := cfg.MaxMergedBytes > 0 && mergedTotal > cfg.MaxMergedBytes
+		if !overMerged && !lowFree() {
+			break
+		}
+		if remaining[f.group] > 0 {
+			continue
+		}
+		n, err := removeMergedOutput(fsys, f.path)
+		if err != nil {
+			logWarn("Failed to delete merged %s: %v", f.path, err)
+			continue
+		}
+		mergedTotal -= n
+		freed += n
+		mergedDeleted++
+		mergedBytes += n
+	}
+
+	if rawDeleted > 0 || mergedDeleted > 0 {
+		logInfo("Cleanup (quota): deleted %d raw segment(s) (%s) and %d merged output(s) (%s)",
+			rawDeleted, formatBytes(rawBytes), mergedDeleted, formatBytes(mergedBytes))
+	}
+	if (cfg.MaxRawBytes > 0 && rawTotal > cfg.MaxRawBytes) || (cfg.MaxMergedBytes > 0 && mergedTotal > cfg.MaxMergedBytes) || lowFree() {
+		logWarn("Cleanup (quota): limits still exceeded (raw=%s merged=%s); the remaining footage is from today or not safely merged",
+			formatBytes(rawTotal), formatBytes(mergedTotal))
+	}
+	return nil
+}
+
+// rawDeletable applies the --days safety rules to every piece of f as if
+// the retention were 0 days.
+func (q *quotaRun) rawDeletable(f *quotaFile, groups map[string]*DayGroup, now time.Time) bool {
+	for _, s := range f.pieces {
+		if s.DurationUnknown || s.EndTime.Before(s.StartTime) || !s.EndTime.Before(dayCutoff(now, s.StartTime.Location(), 0)) {
+			return false
+		}
+		if !q.dayMerged(groups[dayGroupKey(s.SourceKey, s.StartTime.Format("20060102"))], now) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergedOutputs lists the merged outputs that have ended before today,
+// oldest first, and the size of everything in the output folder apart from
+// the quarantine.
+func (q *quotaRun) mergedOutputs(now time.Time) ([]*quotaFile, int64, error) {
+	cfg := q.cfg
+	fsys := cfg.fs()
+	if _, err := fsys.Stat(cfg.OutDir); err != nil {
+		return nil, 0, nil
+	}
+	var out []*quotaFile
+	var total int64
+	quarantineAbs := absClean(cfg.QuarantineDir)
+	err := walkDir(fsys, cfg.OutDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if absClean(path) == quarantineAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		n, ok := mergedScheme{}.Parse(filepath.Dir(path), d.Name())
+		if !ok || !strings.EqualFold(n.Ext, mergedOutExt) || n.End.Before(n.Start) {
+			return nil
+		}
+		sourceKey, err := filepath.Rel(cfg.OutDir, filepath.Dir(path))
+		if err != nil || sourceKey == "." {
+			sourceKey = ""
+		}
+		loc := cfg.locationFor(sourceKey)
+		if !wallClockIn(n.End, loc).Before(dayCutoff(now, loc, 0)) {
+			return nil
+		}
+		out = append(out, &quotaFile{
+			path:  path,
+			start: wallClockIn(n.Start, loc),
+			size:  info.Size(),
+			group: dayGroupKey(sourceKey, n.Start.Format("20060102")),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sortQuotaFiles(out)
+	return out, total, nil
+}
+
+func sortQuotaFiles(files []*quotaFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].start.Equal(files[j].start) {
+			return files[i].start.Before(files[j].start)
+		}
+		return files[i].path < files[j].path
+	})
+}
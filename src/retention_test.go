@@ -0,0 +1,297 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testInDir         = "/cam/in"
+	testOutDir        = "/cam/out"
+	testQuarantineDir = "/cam/quarantine"
+)
+
+// footageFixture is an input folder of Xiaomi segments with merged
+// outputs, on an in-memory filesystem.
+type footageFixture struct {
+	fsys   *memFS
+	merger *recordingMerger
+	loc    *time.Location
+}
+
+func newFootageFixture(loc *time.Location) *footageFixture {
+	fsys := newMemFS()
+	f := &footageFixture{fsys: fsys, merger: newRecordingMerger(fsys), loc: loc}
+	f.fsys.add(filepath.Join(testOutDir, ".keep"), nil)
+	return f
+}
+
+// at parses a wall-clock time in the fixture's timezone.
+func (f *footageFixture) at(ts string) time.Time {
+	t, err := time.ParseInLocation(tsLayout, ts, f.loc)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// segment adds a raw segment named after its wall-clock span.
+func (f *footageFixture) segment(start, end string) string {
+	path := filepath.Join(testInDir, "00_"+start+"_"+end+".mp4")
+	f.fsys.add(path, []byte(start))
+	return path
+}
+
+// merged adds a merged output covering start..end that probes as the sum of
+// the raw footage it replaces.
+func (f *footageFixture) merged(start, end string, d time.Duration) string {
+	path := filepath.Join(testOutDir, start+"_"+end+".mp4")
+	f.fsys.add(path, []byte(start))
+	f.merger.Media[path] = mediaInfo{Duration: d, HasVideo: true}
+	return path
+}
+
+func (f *footageFixture) config(now time.Time) Config {
+	schemes, err := buildSchemes(defaultSchemes, "", "")
+	if err != nil {
+		panic(err)
+	}
+	return Config{
+		Dir:           testInDir,
+		OutDir:        testOutDir,
+		QuarantineDir: testQuarantineDir,
+		Schemes:       schemes,
+		Location:      f.loc,
+		Overlap:       overlapKeep,
+		Merger:        f.merger,
+		Clock:         newFakeClock(now),
+		FS:            f.fsys,
+	}
+}
+
+func intPtr(v int) *int { return &v }
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone %s unavailable: %v", name, err)
+	}
+	return loc
+}
+
+// remaining reports which of paths still exist.
+func remaining(fsys FileSystem, paths ...string) []string {
+	var out []string
+	for _, p := range paths {
+		if _, err := fsys.Stat(p); err == nil {
+			out = append(out, filepath.Base(p))
+		}
+	}
+	return out
+}
+
+func TestCleanupOldRetention(t *testing.T) {
+	const (
+		twoDaysAgo = "00_20240310080000_20240310081000.mp4"
+		yesterday  = "00_20240311120000_20240311121000.mp4"
+		overnight  = "00_20240311235500_20240312000500.mp4"
+		today      = "00_20240312080000_20240312081000.mp4"
+	)
+	all := []string{twoDaysAgo, yesterday, overnight, today}
+	tests := []struct {
+		name       string
+		days       *int
+		mergedDays *int
+		// outputs writes the merged outputs of day 10 and 11.
+		outputs     bool
+		state       map[string]string
+		fingerprint bool
+		want        []string
+	}{
+		{name: "retention not set keeps everything", outputs: true, want: all},
+		// The overnight segment ends today, so it is not a finished-day file.
+		{name: "days=0 keeps today and segments crossing midnight", days: intPtr(0), outputs: true,
+			want: []string{overnight, today}},
+		{name: "days=1 keeps yesterday", days: intPtr(1), outputs: true,
+			want: []string{yesterday, overnight, today}},
+		{name: "unmerged days are kept", days: intPtr(0), want: all},
+		{name: "expired merged output with merge on record", days: intPtr(0), mergedDays: intPtr(1),
+			state: map[string]string{"20240310": dayStatusMerged}, want: []string{yesterday, overnight, today}},
+		{name: "expired merged output without record is kept", days: intPtr(0), mergedDays: intPtr(1), want: all},
+		{name: "expired merged output with fingerprint only", days: intPtr(0), mergedDays: intPtr(1), fingerprint: true,
+			want: []string{yesterday, overnight, today}},
+		{name: "failed merge outweighs fingerprint", days: intPtr(0), mergedDays: intPtr(1), fingerprint: true,
+			state: map[string]string{"20240310": dayStatusFailed}, want: all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFootageFixture(time.UTC)
+			var paths []string
+			for _, name := range all {
+				span := strings.TrimSuffix(strings.TrimPrefix(name, "00_"), ".mp4")
+				paths = append(paths, f.segment(span[:14], span[15:]))
+			}
+			if tt.outputs {
+				f.merged("20240310080000", "20240310081000", 10*time.Minute)
+				f.merged("20240311120000", "20240312000500", 20*time.Minute)
+			}
+			if tt.fingerprint {
+				f.fsys.add(fingerprintPath(testOutDir, "20240310"), []byte("{}"))
+			}
+			state := &runState{Days: make(map[string]*dayState)}
+			for day, status := range tt.state {
+				state.Days[dayGroupKey("", day)] = &dayState{Status: status}
+			}
+			cfg := f.config(f.at("20240312100000"))
+			cfg.Days = tt.days
+			cfg.MergedDays = tt.mergedDays
+			if err := cleanupOld(cfg, state); err != nil {
+				t.Fatal(err)
+			}
+			if got := remaining(f.fsys, paths...); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupOldKeepsUnknownDuration(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	// Legacy names carry no end time and this one cannot be probed.
+	path := filepath.Join(testInDir, "2024031008", "05M00S_1710057900.mp4")
+	f.fsys.add(path, []byte("legacy"))
+	cfg := f.config(f.at("20240312100000"))
+	cfg.Days = intPtr(0)
+	// The day is on record as merged, so only the unknown duration keeps it.
+	cfg.MergedDays = intPtr(0)
+	state := &runState{Days: map[string]*dayState{dayGroupKey("", "20240310"): {Status: dayStatusMerged}}}
+	if err := cleanupOld(cfg, state); err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining(f.fsys, path)) != 1 {
+		t.Fatal("segment of unknown duration was deleted")
+	}
+}
+
+// Day cutoffs follow the calendar, so the 23-hour day of a DST change is
+// neither trimmed nor extended by an hour.
+func TestCleanupOldAcrossDST(t *testing.T) {
+	loc := mustLocation(t, "Europe/Berlin")
+	tests := []struct {
+		name string
+		now  string
+		days int
+		want []string
+	}{
+		{name: "days=0 just after midnight", now: "20240401003000", days: 0,
+			want: []string{"00_20240401001000_20240401002000.mp4"}},
+		{name: "days=1 covers the short day", now: "20240401120000", days: 1,
+			want: []string{"00_20240331003000_20240331004000.mp4", "00_20240331234000_20240331235000.mp4", "00_20240401001000_20240401002000.mp4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFootageFixture(loc)
+			paths := []string{
+				f.segment("20240330233000", "20240330234000"),
+				f.segment("20240331003000", "20240331004000"),
+				f.segment("20240331234000", "20240331235000"),
+				f.segment("20240401001000", "20240401002000"),
+			}
+			f.merged("20240330233000", "20240330234000", 10*time.Minute)
+			f.merged("20240331003000", "20240331235000", 20*time.Minute)
+			cfg := f.config(f.at(tt.now))
+			cfg.Days = intPtr(tt.days)
+			if err := cleanupOld(cfg, &runState{Days: make(map[string]*dayState)}); err != nil {
+				t.Fatal(err)
+			}
+			if got := remaining(f.fsys, paths...); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupMergedRetention(t *testing.T) {
+	berlin := mustLocation(t, "Europe/Berlin")
+	tests := []struct {
+		name    string
+		loc     *time.Location
+		now     string
+		days    *int
+		outputs []string
+		want    []string
+	}{
+		{name: "retention not set", loc: time.UTC, now: "20240312100000",
+			outputs: []string{"20240310080000_20240310081000.mp4"},
+			want:    []string{"20240310080000_20240310081000.mp4"}},
+		{name: "days=0 keeps outputs ending today", loc: time.UTC, now: "20240312100000", days: intPtr(0),
+			outputs: []string{"20240311120000_20240311121000.mp4", "20240311235500_20240312000500.mp4", "20240312080000_20240312081000.mp4"},
+			want:    []string{"20240311235500_20240312000500.mp4", "20240312080000_20240312081000.mp4"}},
+		{name: "days=2", loc: time.UTC, now: "20240312100000", days: intPtr(2),
+			outputs: []string{"20240309230000_20240309231000.mp4", "20240310000000_20240310001000.mp4"},
+			want:    []string{"20240310000000_20240310001000.mp4"}},
+		{name: "DST day is a calendar day", loc: berlin, now: "20240401120000", days: intPtr(1),
+			outputs: []string{"20240330233000_20240330234000.mp4", "20240331003000_20240331004000.mp4"},
+			want:    []string{"20240331003000_20240331004000.mp4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFootageFixture(tt.loc)
+			var paths []string
+			for _, name := range tt.outputs {
+				path := filepath.Join(testOutDir, name)
+				f.fsys.add(path, []byte(name))
+				paths = append(paths, path)
+			}
+			cfg := f.config(f.at(tt.now))
+			cfg.MergedDays = tt.days
+			if err := cleanupMerged(cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := remaining(f.fsys, paths...); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupTimelapsesRetention(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	old := filepath.Join(testOutDir, "20240310080000_20240310081000"+timelapseSuffix)
+	recent := filepath.Join(testOutDir, "20240311080000_20240311081000"+timelapseSuffix)
+	f.fsys.add(old, []byte("old"))
+	f.fsys.add(recent, []byte("recent"))
+	cfg := f.config(f.at("20240312100000"))
+	cfg.TimelapseDays = intPtr(1)
+	if err := cleanupTimelapses(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := remaining(f.fsys, old, recent); len(got) != 1 || got[0] != filepath.Base(recent) {
+		t.Errorf("kept %v, want only %s", got, filepath.Base(recent))
+	}
+}
+
+func TestQuotaDeletesOldestMergedFootage(t *testing.T) {
+	f := newFootageFixture(time.UTC)
+	paths := []string{
+		f.segment("20240310080000", "20240310081000"),
+		f.segment("20240311080000", "20240311081000"),
+		f.segment("20240311235500", "20240312000500"),
+		f.segment("20240312080000", "20240312081000"),
+	}
+	f.merged("20240310080000", "20240310081000", 10*time.Minute)
+	f.merged("20240311080000", "20240312000500", 20*time.Minute)
+	cfg := f.config(f.at("20240312100000"))
+	// Every segment is 14 bytes; two must go.
+	cfg.MaxRawBytes = 2 * 14
+	if err := newQuotaRun(cfg, &runState{Days: make(map[string]*dayState)}).enforce(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Base(paths[2]), filepath.Base(paths[3])}
+	if got := remaining(f.fsys, paths...); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Auto-estimated offsets smaller than this are write latency rather than
+// clock skew and are not applied.
+const skewMinApply = 5 * time.Second
+
+// clockOffset corrects a source's file-name timestamps: a fixed duration
+// added to them, or Auto to derive it per day from file modification times.
+type clockOffset struct {
+	Auto  bool
+	Fixed time.Duration
+}
+
+func (o clockOffset) String() string {
+	if o.Auto {
+		return "auto"
+	}
+	return o.Fixed.String()
+}
+
+func parseClockOffsets(v string) (map[string]clockOffset, error) {
+	entries, err := parseSourceMap(v)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]clockOffset, len(entries))
+	for source, val := range entries {
+		if strings.EqualFold(val, "auto") {
+			offsets[source] = clockOffset{Auto: true}
+			continue
+		}
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset '%s' for source %s (want auto or e.g. -90s)", val, source)
+		}
+		offsets[source] = clockOffset{Fixed: d}
+	}
+	return offsets, nil
+}
+
+// offsetFor returns the configured clock offset of a source; "*" applies to
+// every source without its own entry.
+func (cfg Config) offsetFor(sourceKey string) (clockOffset, bool) {
+	if o, ok := lookupSource(cfg.SourceOffsets, sourceKey); ok {
+		return o, true
+	}
+	o, ok := cfg.SourceOffsets["*"]
+	return o, ok
+}
+
+// segmentSkew is how far the camera clock lags the file system clock for one
+// segment: file modification time minus the end time from its name.
+func segmentSkew(s Segment) time.Duration {
+	return s.ModTime.Sub(s.EndTime)
+}
+
+func medianDuration(ds []time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// applyClockOffsets shifts segment times by each source's configured offset.
+// Auto offsets are estimated per source and day so slow drift is followed.
+func applyClockOffsets(cfg Config, segs []Segment) {
+	if len(cfg.SourceOffsets) == 0 {
+		return
+	}
+	auto := make(map[string][]time.Duration)
+	for _, s := range segs {
+		if o, ok := cfg.offsetFor(s.SourceKey); ok && o.Auto {
+			key := dayGroupKey(s.SourceKey, s.StartTime.Format("20060102"))
+			auto[key] = append(auto[key], segmentSkew(s))
+		}
+	}
+	autoOffsets := make(map[string]time.Duration, len(auto))
+	for key, ds := range auto {
+		if m := medianDuration(ds).Round(time.Second); m >= skewMinApply || m <= -skewMinApply {
+			autoOffsets[key] = m
+		}
+	}
+	for i := range segs {
+		s := &segs[i]
+		o, ok := cfg.offsetFor(s.SourceKey)
+		if !ok {
+			continue
+		}
+		d := o.Fixed
+		if o.Auto {
+			d = autoOffsets[dayGroupKey(s.SourceKey, s.StartTime.Format("20060102"))]
+		}
+		if d == 0 {
+			continue
+		}
+		s.StartTime = s.StartTime.Add(d)
+		s.EndTime = s.EndTime.Add(d)
+	}
+}
+
+// reportSkew logs the estimated clock skew of every source, overall and for
+// its most recent day, next to the configured offset.
+func reportSkew(cfg Config) error {
+	report := cfg
+	report.SourceOffsets = nil
+	segs, err := collectSegments(report)
+	if err != nil {
+		return err
+	}
+	bySource := make(map[string][]Segment)
+	for _, s := range segs {
+		bySource[s.SourceKey] = append(bySource[s.SourceKey], s)
+	}
+	sources := make([]string, 0, len(bySource))
+	for k := range bySource {
+		sources = append(sources, k)
+	}
+	sort.Strings(sources)
+	if len(sources) == 0 {
+		logInfo("Skew report: no segments detected")
+		return nil
+	}
+	for _, source := range sources {
+		ss := bySource[source]
+		sort.Slice(ss, func(i, j int) bool { return ss[i].StartTime.Before(ss[j].StartTime) })
+		all := make([]time.Duration, 0, len(ss))
+		var latest []time.Duration
+		lastDay := ss[len(ss)-1].StartTime.Format("20060102")
+		for _, s := range ss {
+			all = append(all, segmentSkew(s))
+			if s.StartTime.Format("20060102") == lastDay {
+				latest = append(latest, segmentSkew(s))
+			}
+		}
+		configured := "none"
+		if o, ok := cfg.offsetFor(source); ok {
+			configured = o.String()
+		}
+		name := source
+		if name == "" {
+			name = "."
+		}
+		sorted := append([]time.Duration(nil), all...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		logInfo("Skew report: source=%s segments=%d median=%s min=%s max=%s latestDay=%s latestMedian=%s configured=%s",
+			name, len(ss), medianDuration(all).Round(time.Second), sorted[0].Round(time.Second), sorted[len(sorted)-1].Round(time.Second),
+			lastDay, medianDuration(latest).Round(time.Second), configured)
+	}
+	return nil
+}
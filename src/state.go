@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateFileName = ".xiaomi-video-state.json"
+
+	dayStatusMerged = "merged"
+	dayStatusFailed = "failed"
+)
+
+type dayState struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// runState is persisted in the output directory so that scheduled runs can
+// catch up on days missed while the host was down.
+type runState struct {
+	LastSuccess time.Time            `json:"last_success"`
+	Days        map[string]*dayState `json:"days"`
+}
+
+func statePath(cfg Config) string {
+	return filepath.Join(cfg.OutDir, stateFileName)
+}
+
+func loadState(cfg Config) *runState {
+	st := &runState{Days: make(map[string]*dayState)}
+	data, err := cfg.fs().ReadFile(statePath(cfg))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logWarn("Read state file failed, starting fresh: %v", err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		logWarn("Parse state file failed, starting fresh: %v", err)
+		return &runState{Days: make(map[string]*dayState)}
+	}
+	if st.Days == nil {
+		st.Days = make(map[string]*dayState)
+	}
+	return st
+}
+
+func saveState(cfg Config, st *runState) error {
+	fsys := cfg.fs()
+	if err := fsys.MkdirAll(cfg.OutDir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := statePath(cfg)
+	tmp := partialPath(path)
+	if err := fsys.WriteFile(tmp, data, 0o644); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, path)
+}
+
+func (st *runState) record(g *DayGroup, err error, at time.Time) {
+	ds := &dayState{Status: dayStatusMerged, UpdatedAt: at}
+	if err != nil {
+		ds.Status = dayStatusFailed
+		ds.Error = err.Error()
+	}
+	st.Days[dayGroupKey(g.SourceKey, g.Day)] = ds
+}
+
+// pending reports whether a scheduled run should merge the source/day:
+// it failed before, or it completed after the last successful run started.
+func (st *runState) pending(sourceKey, day string, loc *time.Location) bool {
+	if ds, ok := st.Days[dayGroupKey(sourceKey, day)]; ok && ds.Status != dayStatusMerged {
+		return true
+	}
+	if st.LastSuccess.IsZero() {
+		return false
+	}
+	return day >= dayStart(st.LastSuccess.In(loc)).Format("20060102")
+}
+
+// prune forgets days whose raw segments no longer exist.
+func (st *runState) prune(present map[string]*DayGroup) {
+	for key := range st.Days {
+		if _, ok := present[key]; !ok {
+			delete(st.Days, key)
+		}
+	}
+}
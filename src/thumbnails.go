@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Thumbnails sit next to a merged output as <base>-poster.jpg (picked up
+	// by Jellyfin/Kodi) and <base>-contactsheet.jpg.
+	posterSuffix       = "-poster.jpg"
+	contactSheetSuffix = "-contactsheet.jpg"
+	contactSheetCols   = 6
+	contactSheetWidth  = 320
+)
+
+func thumbnailPath(outPath, suffix string) string {
+	return strings.TrimSuffix(outPath, filepath.Ext(outPath)) + suffix
+}
+
+// sheetFrame is one tile of a contact sheet.
+type sheetFrame struct {
+	At    time.Duration
+	Label string
+}
+
+// ensureThumbnails writes the poster and contact sheet of every merged
+// output of a day, rebuilding them when the day was re-merged. Failures are
+// logged only and retried on the next run.
+func ensureThumbnails(cfg Config, g *DayGroup, outDir string, rebuilt bool, lg *logBuffer) {
+	if cfg.ThumbnailInterval <= 0 {
+		return
+	}
+	fsys := cfg.fs()
+	m := cfg.merger()
+	outputs, err := mergedOutputsForDay(fsys, outDir, g.Day)
+	if err != nil {
+		return
+	}
+	for _, out := range outputs {
+		poster := thumbnailPath(out, posterSuffix)
+		sheet := thumbnailPath(out, contactSheetSuffix)
+		if !rebuilt && fileExists(fsys, poster) && fileExists(fsys, sheet) {
+			continue
+		}
+		info, err := m.Probe(out)
+		if err != nil {
+			lg.Warn("Thumbnails skipped for %s: %v", out, err)
+			continue
+		}
+		if err := writePoster(fsys, m, out, info.Duration/2, poster, lg); err != nil {
+			lg.Warn("Write poster failed for %s: %v", out, err)
+		}
+		wall := outputWallClock(cfg, g, out)
+		if err := writeContactSheet(fsys, m, out, info.Duration, cfg.ThumbnailInterval, wall, sheet, lg); err != nil {
+			lg.Warn("Write contact sheet failed for %s: %v", out, err)
+		}
+	}
+}
+
+func fileExists(fsys FileSystem, path string) bool {
+	_, err := fsys.Stat(path)
+	return err == nil
+}
+
+func seekArg(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+func writePoster(fsys FileSystem, m Merger, src string, at time.Duration, dst string, lg *logBuffer) error {
+	tmp := partialPath(dst)
+	if err := m.Frame(src, at, tmp, lg); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, dst)
+}
+
+// writeContactSheet grabs one frame every interval, labelled with its
+// wall-clock time, and tiles the frames into a single image.
+func writeContactSheet(fsys FileSystem, m Merger, src string, duration, interval time.Duration, wall func(time.Duration) time.Time, dst string, lg *logBuffer) error {
+	var frames []sheetFrame
+	for pos := time.Duration(0); pos < duration; pos += interval {
+		frames = append(frames, sheetFrame{At: pos, Label: wall(pos).Format("2006-01-02 15:04:05")})
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("output has no duration")
+	}
+	tmp := partialPath(dst)
+	if err := m.ContactSheet(src, frames, tmp, lg); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, dst)
+}
+
+// runContactSheet grabs the frames with ffmpeg into a temporary directory
+// and tiles them.
+func runContactSheet(src string, frames []sheetFrame, dst string, lg *logBuffer) error {
+	frameDir, err := os.MkdirTemp("", "contactsheet_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(frameDir)
+
+	for i, f := range frames {
+		label := strings.ReplaceAll(f.Label, ":", `\:`)
+		filter := fmt.Sprintf("scale=%d:-2,drawtext=text='%s':x=6:y=h-th-6:fontsize=h/12:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=3",
+			contactSheetWidth, label)
+		frame := filepath.Join(frameDir, fmt.Sprintf("%05d.jpg", i))
+		args := []string{"-y", "-ss", seekArg(f.At), "-i", src, "-frames:v", "1", "-vf", filter, "-q:v", "4", frame}
+		if err := runFFmpeg(args, lg); err != nil {
+			return fmt.Errorf("grab frame at %s: %w", f.At, err)
+		}
+	}
+	cols := contactSheetCols
+	if len(frames) < cols {
+		cols = len(frames)
+	}
+	rows := (len(frames) + cols - 1) / cols
+	args := []string{"-y", "-framerate", "1", "-i", filepath.Join(frameDir, "%05d.jpg"),
+		"-vf", fmt.Sprintf("tile=%dx%d:padding=4:color=black", cols, rows), "-frames:v", "1", "-q:v", "4", dst}
+	return runFFmpeg(args, lg)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Timelapses are named <start>_<end>.timelapse.mp4 after the day's
+	// merged outputs; the double extension keeps them out of merged-output
+	// matching, stale cleanup and merged retention.
+	timelapseSuffix = ".timelapse" + mergedOutExt
+	timelapseFPS    = 25
+	// Above this source step between frames only keyframes are decoded,
+	// trading exact frame spacing for a much faster run.
+	timelapseKeyframeStep = 10 * time.Second
+)
+
+// parseTimelapse reads a speed-up factor ("60x") or a target length ("2m").
+func parseTimelapse(v string) (float64, time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, 0, nil
+	}
+	if f, ok := strings.CutSuffix(strings.ToLower(v), "x"); ok {
+		speed, err := strconv.ParseFloat(f, 64)
+		if err != nil || speed <= 1 {
+			return 0, 0, fmt.Errorf("speed-up '%s' must be a number > 1 followed by x", v)
+		}
+		return speed, 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("'%s' must be a speed-up like 60x or a target length like 2m", v)
+	}
+	return 0, d, nil
+}
+
+func timelapseEnabled(cfg Config) bool {
+	return cfg.TimelapseSpeed > 0 || cfg.TimelapseLength > 0
+}
+
+func isTimelapseName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), timelapseSuffix)
+}
+
+// timelapseSpeed returns the speed-up for a day of the given recorded length.
+func timelapseSpeed(cfg Config, recorded time.Duration) float64 {
+	if cfg.TimelapseSpeed > 0 {
+		return cfg.TimelapseSpeed
+	}
+	speed := float64(recorded) / float64(cfg.TimelapseLength)
+	if speed < 1 {
+		speed = 1
+	}
+	return speed
+}
+
+// ensureTimelapse writes the timelapse of a merged day from its merged
+// outputs. Existing timelapses are kept unless the day was just rebuilt.
+// Failures are logged only; a missing timelapse is retried on the next run.
+func ensureTimelapse(cfg Config, g *DayGroup, outDir string, rebuilt bool, lg *logBuffer) {
+	if !timelapseEnabled(cfg) {
+		return
+	}
+	fsys := cfg.fs()
+	outputs, err := mergedOutputsForDay(fsys, outDir, g.Day)
+	if err != nil || len(outputs) == 0 {
+		return
+	}
+	sort.Strings(outputs)
+	first, _ := mergedScheme{}.Parse(outDir, filepath.Base(outputs[0]))
+	last, _ := mergedScheme{}.Parse(outDir, filepath.Base(outputs[len(outputs)-1]))
+	name := first.Start.Format(tsLayout) + "_" + last.End.Format(tsLayout) + timelapseSuffix
+	path := filepath.Join(outDir, name)
+	if _, err := fsys.Stat(path); err == nil && !rebuilt {
+		return
+	}
+
+	inputs := make([]Segment, 0, len(outputs))
+	for _, p := range outputs {
+		inputs = append(inputs, Segment{Path: p})
+	}
+	speed := timelapseSpeed(cfg, segmentsDuration(g.Segments))
+	step := time.Duration(speed * float64(time.Second) / timelapseFPS)
+	tmp := partialPath(path)
+	m := cfg.merger()
+
+	lg.Info("Writing %.0fx timelapse -> %s", speed, path)
+	if err := m.Timelapse(inputs, step, tmp, lg); err != nil {
+		_ = fsys.Remove(tmp)
+		lg.Warn("Timelapse failed for source=%s day=%s: %v", g.SourceKey, g.Day, err)
+		return
+	}
+	if err := commitOutput(fsys, m, tmp, path, lg); err != nil {
+		lg.Warn("Timelapse failed for source=%s day=%s: %v", g.SourceKey, g.Day, err)
+		return
+	}
+	removeStaleTimelapses(fsys, outDir, g.Day, name, lg)
+}
+
+// runTimelapse encodes the concatenated inputs with ffmpeg, keeping one
+// frame per step.
+func runTimelapse(inputs []Segment, step time.Duration, dst string, lg *logBuffer) error {
+	listFile, cleanup, err := writeConcatList(inputs)
+	if err != nil {
+		return fmt.Errorf("create concat list: %w", err)
+	}
+	defer cleanup()
+	args := []string{"-y"}
+	if step >= timelapseKeyframeStep {
+		args = append(args, "-skip_frame", "nokey")
+	}
+	args = append(args, "-f", "concat", "-safe", "0", "-i", listFile,
+		"-vf", fmt.Sprintf("select='isnan(prev_selected_t)+gte(t-prev_selected_t\\,%.3f)',setpts=N/(%d*TB)", step.Seconds(), timelapseFPS),
+		"-r", strconv.Itoa(timelapseFPS), "-an",
+		"-c:v", burnVideoCodec, "-preset", burnVideoPreset, "-crf", burnVideoCRF, "-pix_fmt", "yuv420p",
+		"-movflags", "+faststart", dst)
+	return runFFmpeg(args, lg)
+}
+
+// removeStaleTimelapses deletes other timelapses of day, left from an
+// earlier merge with different outputs.
+func removeStaleTimelapses(fsys FileSystem, outDir, day, keep string, lg *logBuffer) {
+	entries, err := fsys.ReadDir(outDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || name == keep || !isTimelapseName(name) {
+			continue
+		}
+		n, ok := mergedScheme{}.Parse(outDir, name)
+		if !ok || n.Start.Format("20060102") != day {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(outDir, name)); err != nil {
+			lg.Warn("Failed to remove stale timelapse %s: %v", filepath.Join(outDir, name), err)
+		}
+	}
+}
+
+// cleanupTimelapses applies the timelapse retention.
+func cleanupTimelapses(cfg Config) error {
+	if cfg.TimelapseDays == nil {
+		return nil
+	}
+	fsys := cfg.fs()
+	if _, err := fsys.Stat(cfg.OutDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := cfg.clock().Now()
+	days := *cfg.TimelapseDays
+	quarantineAbs := absClean(cfg.QuarantineDir)
+	var toDelete []string
+	err := walkDir(fsys, cfg.OutDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if absClean(path) == quarantineAbs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !isTimelapseName(d.Name()) {
+			return nil
+		}
+		n, ok := mergedScheme{}.Parse(filepath.Dir(path), d.Name())
+		if !ok {
+			return nil
+		}
+		sourceKey, err := filepath.Rel(cfg.OutDir, filepath.Dir(path))
+		if err != nil || sourceKey == "." {
+			sourceKey = ""
+		}
+		loc := cfg.locationFor(sourceKey)
+		if wallClockIn(n.End, loc).Before(dayCutoff(now, loc, days)) {
+			toDelete = append(toDelete, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(toDelete) == 0 {
+		return nil
+	}
+	sort.Strings(toDelete)
+	logInfo("Cleanup (timelapse): deleting %d file(s) older than %d days", len(toDelete), days)
+	for _, p := range toDelete {
+		if err := fsys.Remove(p); err != nil {
+			logWarn("Failed to delete timelapse %s: %v", p, err)
+		}
+	}
+	return nil
+}
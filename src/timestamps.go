@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	timestampsSRT     = "srt"
+	timestampsVTT     = "vtt"
+	timestampsMovText = "mov_text"
+	timestampsBurn    = "burn"
+
+	timestampTextLayout = "2006-01-02 15:04:05"
+
+	// Encoder settings used when timestamps are burned into the frame.
+	burnVideoCodec  = "libx264"
+	burnVideoPreset = "veryfast"
+	burnVideoCRF    = "23"
+)
+
+func validTimestampMode(mode string) bool {
+	switch mode {
+	case "", timestampsSRT, timestampsVTT, timestampsMovText, timestampsBurn:
+		return true
+	}
+	return false
+}
+
+// timelineRun is a stretch of output where playback position and wall
+// clock advance together, i.e. consecutive segments without a pause.
+type timelineRun struct {
+	Pos   time.Duration
+	Len   time.Duration
+	Start time.Time
+}
+
+func timelineRuns(segs []Segment) []timelineRun {
+	offsets := segmentOffsets(segs)
+	var runs []timelineRun
+	for i, s := range segs {
+		d := s.EndTime.Sub(s.StartTime)
+		if d <= 0 {
+			continue
+		}
+		if n := len(runs); n > 0 {
+			last := &runs[n-1]
+			drift := s.StartTime.Sub(last.Start.Add(last.Len))
+			_, lastOffset := last.Start.Zone()
+			_, offset := s.StartTime.Zone()
+			// A DST change starts a new run so the rendered clock jumps too.
+			if drift < time.Second && drift > -time.Second && offset == lastOffset {
+				last.Len += d
+				continue
+			}
+		}
+		runs = append(runs, timelineRun{Pos: offsets[i], Len: d, Start: s.StartTime})
+	}
+	return runs
+}
+
+func formatCueTime(d time.Duration, sep string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
+
+// writeTimestampCues writes one cue per second of footage carrying the real
+// time of that second, in SubRip or WebVTT format.
+func writeTimestampCues(fsys FileSystem, path string, segs []Segment, format string) error {
+	f, err := fsys.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	sep := ","
+	if format == timestampsVTT {
+		sep = "."
+		fmt.Fprint(w, "WEBVTT\n\n")
+	}
+	n := 0
+	for _, r := range timelineRuns(segs) {
+		for off := time.Duration(0); off < r.Len; off += time.Second {
+			end := off + time.Second
+			if end > r.Len {
+				end = r.Len
+			}
+			n++
+			if format != timestampsVTT {
+				fmt.Fprintf(w, "%d\n", n)
+			}
+			fmt.Fprintf(w, "%s --> %s\n%s\n\n", formatCueTime(r.Pos+off, sep), formatCueTime(r.Pos+end, sep), r.Start.Add(off).Format(timestampTextLayout))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeTimestampFilter writes a drawtext filter chain rendering the wall
+// clock, one drawtext per timeline run so that gaps are reflected. The clock
+// is rendered as gmtime shifted by the camera's UTC offset, so it does not
+// depend on the process timezone.
+func writeTimestampFilter(path string, segs []Segment, extra string) error {
+	runs := timelineRuns(segs)
+	parts := make([]string, 0, len(runs))
+	for _, r := range runs {
+		_, offset := r.Start.Zone()
+		epoch := r.Start.Unix() + int64(offset) - int64(r.Pos/time.Second)
+		from := r.Pos.Seconds()
+		to := (r.Pos + r.Len).Seconds()
+		parts = append(parts, fmt.Sprintf(
+			"drawtext=text='%%{pts\\:gmtime\\:%d}':enable='gte(t,%.3f)*lt(t,%.3f)':x=16:y=16:fontsize=h/24:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=6",
+			epoch, from, to))
+	}
+	if extra != "" {
+		parts = append(parts, extra)
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "null")
+	}
+	return os.WriteFile(path, []byte(strings.Join(parts, ",")), 0o644)
+}
+
+func timestampTempFile(pattern string) (string, func(), error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", func() {}, err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		_ = os.Remove(name)
+		return "", func() {}, err
+	}
+	return name, func() { _ = os.Remove(name) }, nil
+}
+
+// prepareTimestamps attaches subtitle or burn-in inputs to a concat job for
+// the configured mode. Sidecar modes are written after the merge instead.
+func prepareTimestamps(mode string, job *concatJob, segs []Segment) (func(), error) {
+	switch mode {
+	case timestampsMovText:
+		path, cleanup, err := timestampTempFile("timestamps_*.srt")
+		if err != nil {
+			return func() {}, err
+		}
+		if err := writeTimestampCues(osFS{}, path, segs, timestampsSRT); err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		job.SubtitleFile = path
+		return cleanup, nil
+	case timestampsBurn:
+		path, cleanup, err := timestampTempFile("drawtext_*.txt")
+		if err != nil {
+			return func() {}, err
+		}
+		if err := writeTimestampFilter(path, segs, job.Transcode.videoFilter()); err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		job.VideoFilterFile = path
+		return cleanup, nil
+	}
+	return func() {}, nil
+}
+
+func sidecarPath(outPath, ext string) string {
+	return strings.TrimSuffix(outPath, filepath.Ext(outPath)) + ext
+}
+
+// writeTimestampSidecar writes <output>.srt/.vtt next to a merged output.
+func writeTimestampSidecar(fsys FileSystem, mode, outPath string, segs []Segment) error {
+	if mode != timestampsSRT && mode != timestampsVTT {
+		return nil
+	}
+	path := sidecarPath(outPath, "."+mode)
+	tmp := partialPath(path)
+	if err := writeTimestampCues(fsys, tmp, segs, mode); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, path)
+}
+
+// removeCompanions deletes files sharing a merged output's base name, such
+// as subtitle sidecars, and returns the bytes freed.
+func removeCompanions(fsys FileSystem, outPath string, lg *logBuffer) int64 {
+	base := strings.TrimSuffix(filepath.Base(outPath), filepath.Ext(outPath))
+	dir := filepath.Dir(outPath)
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var freed int64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || name == filepath.Base(outPath) {
+			continue
+		}
+		// Timelapses share the base name but have their own retention.
+		if !(strings.HasPrefix(name, base+".") || strings.HasPrefix(name, base+"-")) || isTimelapseName(name) {
+			continue
+		}
+		info, _ := e.Info()
+		if err := fsys.Remove(filepath.Join(dir, name)); err != nil {
+			lg.Warn("Failed to remove companion file %s: %v", filepath.Join(dir, name), err)
+			continue
+		}
+		if info != nil {
+			freed += info.Size()
+		}
+	}
+	return freed
+}
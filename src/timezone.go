@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// parseSourceMap parses "source=value,source=value" settings. Sources are
+// matched by folder path relative to the input (or output) directory.
+func parseSourceMap(v string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(entry, "=")
+		k = strings.Trim(filepath.ToSlash(strings.TrimSpace(k)), "/")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid entry '%s' (want source=value)", entry)
+		}
+		m[k] = strings.TrimSpace(val)
+	}
+	return m, nil
+}
+
+// lookupSource returns the value for sourceKey, falling back to the closest
+// parent folder that has one (so "cam1" also covers "cam1/01").
+func lookupSource[T any](m map[string]T, sourceKey string) (T, bool) {
+	key := filepath.ToSlash(sourceKey)
+	for {
+		if v, ok := m[key]; ok {
+			return v, true
+		}
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			var zero T
+			return zero, false
+		}
+		key = key[:i]
+	}
+}
+
+func parseLocations(global, perSource string) (*time.Location, map[string]*time.Location, error) {
+	loc := time.Local
+	if name := strings.TrimSpace(global); name != "" {
+		l, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown timezone '%s': %w", name, err)
+		}
+		loc = l
+	}
+	entries, err := parseSourceMap(perSource)
+	if err != nil {
+		return nil, nil, err
+	}
+	locs := make(map[string]*time.Location, len(entries))
+	for source, name := range entries {
+		l, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown timezone '%s' for source %s: %w", name, source, err)
+		}
+		locs[source] = l
+	}
+	return loc, locs, nil
+}
+
+// locationFor returns the timezone the cameras of a source write in.
+func (cfg Config) locationFor(sourceKey string) *time.Location {
+	if l, ok := lookupSource(cfg.SourceLocations, sourceKey); ok {
+		return l
+	}
+	if cfg.Location != nil {
+		return cfg.Location
+	}
+	return time.Local
+}
+
+// wallClockIn reinterprets the wall clock of t (as parsed from a file name)
+// in loc.
+func wallClockIn(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// dayCutoff returns the start of the day `days` calendar days before now in
+// loc; calendar arithmetic keeps 23/25-hour DST days intact.
+func dayCutoff(now time.Time, loc *time.Location, days int) time.Time {
+	return dayStart(now.In(loc).AddDate(0, 0, -days))
+}
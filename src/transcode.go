@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	transcodeCopy = "copy"
+	transcodeH264 = "h264"
+	transcodeH265 = "h265"
+	transcodeAV1  = "av1"
+
+	audioCopy   = "copy"
+	audioDrop   = "drop"
+	audioMono   = "mono"
+	audioStereo = "stereo"
+)
+
+// transcodeEncoders maps profile codecs to CPU encoders and their defaults.
+var transcodeEncoders = map[string]struct {
+	Encoder string
+	Preset  string
+	CRF     int
+}{
+	transcodeH264: {"libx264", "medium", 23},
+	transcodeH265: {"libx265", "medium", 28},
+	transcodeAV1:  {"libsvtav1", "8", 35},
+}
+
+// transcodeProfile describes how merged outputs are encoded, written as
+// codec[:key=value...], e.g. h265:crf=28:max-height=720:fps=15:audio=mono.
+type transcodeProfile struct {
+	Codec     string
+	CRF       int
+	Bitrate   string
+	MaxWidth  int
+	MaxHeight int
+	FPS       string
+	Preset    string
+	Audio     string
+}
+
+func parseTranscodeProfile(v string) (transcodeProfile, error) {
+	p := transcodeProfile{Codec: transcodeCopy, Audio: audioCopy}
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return p, nil
+	}
+	parts := strings.Split(v, ":")
+	switch codec := strings.ToLower(strings.TrimSpace(parts[0])); codec {
+	case transcodeCopy, transcodeH264, transcodeH265, transcodeAV1:
+		p.Codec = codec
+	case "avc", "x264":
+		p.Codec = transcodeH264
+	case "hevc", "x265":
+		p.Codec = transcodeH265
+	default:
+		return p, fmt.Errorf("unknown codec '%s' (want copy, h264, h265 or av1)", parts[0])
+	}
+	for _, opt := range parts[1:] {
+		k, val, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		val = strings.TrimSpace(val)
+		if !ok || val == "" {
+			return p, fmt.Errorf("invalid option '%s' (want key=value)", opt)
+		}
+		var err error
+		switch k {
+		case "crf":
+			p.CRF, err = positiveInt(k, val)
+		case "bitrate":
+			p.Bitrate = val
+		case "max-width":
+			p.MaxWidth, err = positiveInt(k, val)
+		case "max-height":
+			p.MaxHeight, err = positiveInt(k, val)
+		case "fps":
+			if f, perr := strconv.ParseFloat(val, 64); perr != nil || f <= 0 {
+				err = fmt.Errorf("invalid fps '%s'", val)
+			}
+			p.FPS = val
+		case "preset":
+			p.Preset = val
+		case "audio":
+			p.Audio = strings.ToLower(val)
+			if p.Audio != audioCopy && p.Audio != audioDrop && p.Audio != audioMono && p.Audio != audioStereo {
+				err = fmt.Errorf("invalid audio '%s' (want copy, drop, mono or stereo)", val)
+			}
+		default:
+			err = fmt.Errorf("unknown option '%s'", k)
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+	if !p.reencodes() && (p.CRF != 0 || p.Bitrate != "" || p.MaxWidth != 0 || p.MaxHeight != 0 || p.FPS != "" || p.Preset != "") {
+		return p, fmt.Errorf("video options need a codec other than copy")
+	}
+	return p, nil
+}
+
+func positiveInt(name, v string) (int, error) {
+	i, err := strconv.Atoi(v)
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", name, v)
+	}
+	return i, nil
+}
+
+// parseTranscodeProfiles parses per-source profiles, e.g. cam1=h265:crf=30,cam2=copy.
+func parseTranscodeProfiles(v string) (map[string]transcodeProfile, error) {
+	entries, err := parseSourceMap(v)
+	if err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]transcodeProfile, len(entries))
+	for source, val := range entries {
+		p, err := parseTranscodeProfile(val)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", source, err)
+		}
+		profiles[source] = p
+	}
+	return profiles, nil
+}
+
+func (p transcodeProfile) reencodes() bool {
+	return p.Codec != "" && p.Codec != transcodeCopy
+}
+
+func (p transcodeProfile) String() string {
+	s := p.Codec
+	if p.CRF > 0 {
+		s += fmt.Sprintf(":crf=%d", p.CRF)
+	}
+	if p.Bitrate != "" {
+		s += ":bitrate=" + p.Bitrate
+	}
+	if p.MaxWidth > 0 {
+		s += fmt.Sprintf(":max-width=%d", p.MaxWidth)
+	}
+	if p.MaxHeight > 0 {
+		s += fmt.Sprintf(":max-height=%d", p.MaxHeight)
+	}
+	if p.FPS != "" {
+		s += ":fps=" + p.FPS
+	}
+	if p.Preset != "" {
+		s += ":preset=" + p.Preset
+	}
+	return s + ":audio=" + p.Audio
+}
+
+// transcodeFor returns the profile of a source, falling back to the global one.
+func (cfg Config) transcodeFor(sourceKey string) transcodeProfile {
+	if p, ok := lookupSource(cfg.SourceTranscode, sourceKey); ok {
+		return p
+	}
+	return cfg.Transcode
+}
+
+// anyReencode reports whether any source is merged with a video encoder.
+func (cfg Config) anyReencode() bool {
+	if cfg.Transcode.reencodes() || cfg.Timestamps == timestampsBurn {
+		return true
+	}
+	for _, p := range cfg.SourceTranscode {
+		if p.reencodes() {
+			return true
+		}
+	}
+	return false
+}
+
+// videoFilter returns the scale/fps filter chain of the profile, or "".
+func (p transcodeProfile) videoFilter() string {
+	var filters []string
+	switch {
+	case p.MaxWidth > 0 && p.MaxHeight > 0:
+		filters = append(filters, fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease:force_divisible_by=2", p.MaxWidth, p.MaxHeight))
+	case p.MaxHeight > 0:
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(%d,ih)'", p.MaxHeight))
+	case p.MaxWidth > 0:
+		filters = append(filters, fmt.Sprintf("scale='min(%d,iw)':-2", p.MaxWidth))
+	}
+	if p.FPS != "" {
+		filters = append(filters, "fps="+p.FPS)
+	}
+	return strings.Join(filters, ",")
+}
+
+// videoArgs returns the encoder arguments of a re-encoding profile.
+func (p transcodeProfile) videoArgs() []string {
+	enc := transcodeEncoders[p.Codec]
+	preset := p.Preset
+	if preset == "" {
+		preset = enc.Preset
+	}
+	args := []string{"-c:v", enc.Encoder, "-preset", preset, "-pix_fmt", "yuv420p"}
+	if p.Bitrate != "" {
+		args = append(args, "-b:v", p.Bitrate)
+	} else {
+		crf := p.CRF
+		if crf == 0 {
+			crf = enc.CRF
+		}
+		args = append(args, "-crf", strconv.Itoa(crf))
+	}
+	if p.Codec == transcodeH265 {
+		// hvc1 lets Apple players open H.265 MP4 files.
+		args = append(args, "-tag:v", "hvc1")
+	}
+	return args
+}
+
+func (p transcodeProfile) audioArgs() []string {
+	switch p.Audio {
+	case audioDrop:
+		return []string{"-an"}
+	case audioMono:
+		return []string{"-c:a", "aac", "-ac", "1", "-b:a", "64k"}
+	case audioStereo:
+		return []string{"-c:a", "aac", "-ac", "2", "-b:a", "128k"}
+	}
+	return nil
+}
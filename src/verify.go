@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// A merged day counts as complete when its total duration is within
+	// this tolerance of the summed segment durations.
+	verifyToleranceRatio = 0.02
+	verifyToleranceMin   = 30 * time.Second
+)
+
+func sourceOutDir(cfg Config, sourceKey string) string {
+	if sourceKey == "" {
+		return cfg.OutDir
+	}
+	return filepath.Join(cfg.OutDir, sourceKey)
+}
+
+// mergedOutputsForDay lists merged outputs in outDir whose start is on day.
+func mergedOutputsForDay(fsys FileSystem, outDir, day string) ([]string, error) {
+	entries, err := fsys.ReadDir(outDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		n, ok := mergedScheme{}.Parse(outDir, e.Name())
+		if !ok || !strings.EqualFold(n.Ext, mergedOutExt) {
+			continue
+		}
+		if n.Start.Format("20060102") != day {
+			continue
+		}
+		paths = append(paths, filepath.Join(outDir, e.Name()))
+	}
+	return paths, nil
+}
+
+func segmentsDuration(segs []Segment) time.Duration {
+	var total time.Duration
+	for _, s := range segs {
+		if d := s.EndTime.Sub(s.StartTime); d > 0 {
+			total += d
+		}
+	}
+	return total
+}
+
+// mergedExpired reports whether the merged output of g is past --merged-days
+// and the day is on record as merged: the run state says so or, without a
+// state entry, a fingerprint was written. A day whose merge failed or never
+// ran is never treated as merged just because it is old.
+func mergedExpired(cfg Config, state *runState, g *DayGroup, now time.Time) bool {
+	if cfg.MergedDays == nil {
+		return false
+	}
+	last := g.Segments[len(g.Segments)-1]
+	if !last.EndTime.Before(dayCutoff(now, last.StartTime.Location(), *cfg.MergedDays)) {
+		return false
+	}
+	if state != nil {
+		if ds, ok := state.Days[dayGroupKey(g.SourceKey, g.Day)]; ok {
+			return ds.Status == dayStatusMerged
+		}
+	}
+	_, err := cfg.fs().Stat(fingerprintPath(sourceOutDir(cfg, g.SourceKey), g.Day))
+	return err == nil
+}
+
+// verifyDayMerged checks that the merged output(s) for a source/day exist,
+// are readable by ffprobe and cover the group's recorded duration. In a dry
+// run, days the run would merge count as merged.
+func verifyDayMerged(cfg Config, g *DayGroup) error {
+	if cfg.Plan != nil && cfg.Plan.plannedMerged(g) {
+		return nil
+	}
+	outDir := sourceOutDir(cfg, g.SourceKey)
+	paths, err := mergedOutputsForDay(cfg.fs(), outDir, g.Day)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no merged output in %s", outDir)
+	}
+	var actual time.Duration
+	for _, p := range paths {
+		info, err := cfg.merger().Probe(p)
+		if err != nil {
+			return fmt.Errorf("merged output %s is unreadable: %w", p, err)
+		}
+		actual += info.Duration
+	}
+	// The merge recorded what it covered; only days merged by older
+	// versions or with changed segments resolve overlaps again.
+	fp, ok := readCurrentFingerprint(cfg.fs(), outDir, g.Day, groupFingerprint(cfg, g))
+	expected := fp.Expected
+	if !ok || expected <= 0 {
+		segs, _ := resolveOverlaps(cfg.fs(), cfg.Overlap, g.Segments)
+		expected = segmentsDuration(segs)
+	}
+	tolerance := time.Duration(float64(expected) * verifyToleranceRatio)
+	if tolerance < verifyToleranceMin {
+		tolerance = verifyToleranceMin
+	}
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		return fmt.Errorf("merged duration %s differs from segments %s by more than %s",
+			actual.Truncate(time.Second), expected.Truncate(time.Second), tolerance.Truncate(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Stream-copy merges are bound by disk I/O, where more than a couple of
+// concurrent readers mostly adds seeking.
+const defaultCopyWorkers = 2
+
+type logRecord struct {
+	at    time.Time
+	level string
+	msg   string
+}
+
+// logBuffer collects the log lines of one merge so that concurrent merges
+// can be printed in order. A nil *logBuffer logs directly.
+type logBuffer struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (b *logBuffer) add(level, format string, args ...any) {
+	if b == nil {
+		logLine(level, format, args...)
+		return
+	}
+	b.mu.Lock()
+	b.records = append(b.records, logRecord{at: time.Now(), level: level, msg: fmt.Sprintf(format, args...)})
+	b.mu.Unlock()
+}
+
+func (b *logBuffer) Info(format string, args ...any)  { b.add("INFO", format, args...) }
+func (b *logBuffer) Warn(format string, args ...any)  { b.add("WARN", format, args...) }
+func (b *logBuffer) Error(format string, args ...any) { b.add("ERROR", format, args...) }
+
+func (b *logBuffer) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.records {
+		logLineAt(r.at, r.level, "%s", r.msg)
+	}
+	b.records = nil
+}
+
+// mergeWorkers picks the merge concurrency: the configured value, or an
+// I/O-friendly default that drops to one worker when re-encoding.
+func mergeWorkers(cfg Config, groups int) int {
+	n := cfg.Workers
+	if n <= 0 {
+		n = defaultCopyWorkers
+		if cfg.anyReencode() {
+			n = 1
+		}
+		if cpus := runtime.NumCPU(); n > cpus {
+			n = cpus
+		}
+	}
+	if n > groups {
+		n = groups
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// mergeGroups merges groups on a bounded worker pool. Logs of each group are
+// printed in group order and failures are aggregated per group; onDone is
+// called for every group in the same order.
+func mergeGroups(cfg Config, groups []*DayGroup, onDone func(*DayGroup, error)) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	workers := mergeWorkers(cfg, len(groups))
+	if workers > 1 {
+		logInfo("Merging %d source/day group(s) with %d workers", len(groups), workers)
+	}
+
+	type result struct {
+		err error
+		lg  *logBuffer
+	}
+	results := make([]chan result, len(groups))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var lg *logBuffer
+				if workers > 1 {
+					lg = &logBuffer{}
+				}
+				err := mergeGroup(cfg, groups[i], lg)
+				results[i] <- result{err: err, lg: lg}
+			}
+		}()
+	}
+	go func() {
+		for i := range groups {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var errs []error
+	successDays := 0
+	for i, g := range groups {
+		r := <-results[i]
+		r.lg.flush()
+		onDone(g, r.err)
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("source=%s day=%s: %w", g.SourceKey, g.Day, r.err))
+			continue
+		}
+		successDays++
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		logWarn("Merging finished with errors; successful days: %d, failed days: %d", successDays, len(errs))
+		return errors.Join(errs...)
+	}
+	logInfo("Merging finished; successful days: %d", successDays)
+	return nil
+}